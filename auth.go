@@ -0,0 +1,158 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// StrengthAuth is the bit in Thello.Strength a client sets to ask for
+// authentication.
+//
+// A client asking for it follows its Thello with a Tauth0 and, after the
+// Rauth0, a Tauth1. The server runs its Authenticator, and only then calls
+// the Handshake and sends the Rhello. Any failure is an Rerror and a closed
+// connection.
+const StrengthAuth uint8 = 1 << 0
+
+// An Authenticator is the server side of an authentication exchange.
+//
+// The data each message carries is up to the method; each is at most 255
+// bytes.
+//
+// The hello passed to Verify, and to the ClientAuth's Respond and Check, is
+// the strength, crypto, and codec offers from the client's Thello. Methods
+// should cover it in their proofs, so nobody on the path can change the
+// offers, say to strip the crypto ones, without failing the exchange.
+type Authenticator interface {
+	// Challenge answers a Tauth0 from the client claiming to be uid,
+	// returning the data for the Rauth0.
+	Challenge(uid, method string, t0 []byte) ([]byte, error)
+	// Verify answers the Tauth1, given everything sent so far, returning
+	// the data for the Rauth1. An error refuses the client.
+	Verify(uid, method string, hello, t0, r0, t1 []byte) ([]byte, error)
+}
+
+// A ClientAuth is the client side of an authentication exchange.
+type ClientAuth interface {
+	// Method is the name sent in the Tauth0.
+	Method() string
+	// Start returns the data for the Tauth0.
+	Start(uid string) ([]byte, error)
+	// Respond returns the data for the Tauth1.
+	Respond(uid string, hello, t0, r0 []byte) ([]byte, error)
+	// Check returns an error if the server's Rauth1 isn't right, for
+	// methods where the server proves itself too.
+	Check(uid string, hello, t0, r0, t1, r1 []byte) error
+}
+
+// HelloOffers is the hello the auth methods see, made from a Thello's
+// fields.
+func helloOffers(strength uint8, crypto, codec []byte) []byte {
+	b := []byte{strength, uint8(len(crypto))}
+	b = append(b, crypto...)
+	b = append(b, uint8(len(codec)))
+	return append(b, codec...)
+}
+
+// SecretMethod is the method name used by Secret and Secrets.
+const SecretMethod = "hmac-sha256"
+
+const nonceSize = 32
+
+// Secret is a ClientAuth that proves the client and the server know the
+// same secret.
+//
+// Each side sends a random nonce. The client answers with an HMAC-SHA256,
+// keyed with the secret, of the uid, the hello, and both nonces, and the
+// server answers with one of its own, so neither end can be impersonated
+// by someone who doesn't know the secret. The secret itself is never sent.
+//
+// Secret is a KeyedAuth, so sessions using it can be encrypted.
+type Secret []byte
+
+func (s Secret) Method() string { return SecretMethod }
+
+func (s Secret) Start(_ string) ([]byte, error) {
+	return nonce()
+}
+
+func (s Secret) Respond(uid string, hello, t0, r0 []byte) ([]byte, error) {
+	if len(r0) != nonceSize {
+		return nil, fmt.Errorf("%w: bad challenge", ErrAuth)
+	}
+	return secretMAC(s, "client", uid, hello, t0, r0), nil
+}
+
+func (s Secret) Check(uid string, hello, t0, r0, _, r1 []byte) error {
+	if !hmac.Equal(r1, secretMAC(s, "server", uid, hello, t0, r0)) {
+		return fmt.Errorf("%w: server doesn't know the secret", ErrAuth)
+	}
+	return nil
+}
+
+// SessionKey makes Secret a KeyedAuth. The key is an HMAC of both nonces,
+// like the proofs.
+func (s Secret) SessionKey(uid string, t0, r0, _ []byte) ([]byte, error) {
+	return secretMAC(s, "session", uid, nil, t0, r0), nil
+}
+
+// Secrets is an Authenticator for clients using Secret. It maps each uid
+// to its secret.
+type Secrets map[string][]byte
+
+func (s Secrets) Challenge(_, method string, t0 []byte) ([]byte, error) {
+	if method != SecretMethod {
+		return nil, fmt.Errorf("%w: unknown method %q", ErrAuth, method)
+	}
+	if len(t0) != nonceSize {
+		return nil, fmt.Errorf("%w: bad nonce", ErrAuth)
+	}
+	// Unknown users get a challenge too, and fail in Verify, so nobody
+	// can find out who exists.
+	return nonce()
+}
+
+func (s Secrets) Verify(uid, _ string, hello, t0, r0, t1 []byte) ([]byte, error) {
+	key, ok := s[uid]
+	if !ok || !hmac.Equal(t1, secretMAC(key, "client", uid, hello, t0, r0)) {
+		return nil, fmt.Errorf("%w for %q", ErrAuth, uid)
+	}
+	return secretMAC(key, "server", uid, hello, t0, r0), nil
+}
+
+// SessionKey makes Secrets a KeyedAuthenticator.
+func (s Secrets) SessionKey(uid, _ string, t0, r0, _ []byte) ([]byte, error) {
+	key, ok := s[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w for %q", ErrAuth, uid)
+	}
+	return secretMAC(key, "session", uid, nil, t0, r0), nil
+}
+
+func nonce() ([]byte, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SecretMAC is the proof one side sends. The label keeps the client's and
+// server's proofs different.
+func secretMAC(key []byte, label, uid string, hello, t0, r0 []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	var n [2]byte
+	for _, b := range [][]byte{[]byte(label), []byte(uid), hello, t0, r0} {
+		binary.BigEndian.PutUint16(n[:], uint16(len(b)))
+		m.Write(n[:])
+		m.Write(b)
+	}
+	return m.Sum(nil)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// StartAuthServer serves a MemFS with srv, reporting each client's hello on
+// the returned channel.
+func startAuthServer(t *testing.T, srv *venti.Server) (net.Listener, chan *venti.Thello) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hellos := make(chan *venti.Thello, 1)
+	fs := ventitest.NewMemFS()
+	srv.Handshake = func(th *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+		hellos <- th
+		return fs.Handshake(th)
+	}
+	go srv.Serve(l)
+	return l, hellos
+}
+
+func TestSecretAuth(t *testing.T) {
+	l, hellos := startAuthServer(t, &venti.Server{
+		Auth: venti.Secrets{"glenda": []byte("sesame")},
+	})
+	defer l.Close()
+
+	c, err := dial(t, l, nil, &venti.ClientConfig{UID: "glenda", Auth: venti.Secret("sesame")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := <-hellos
+	if th.UID != "glenda" || th.AuthMethod != venti.SecretMethod {
+		t.Fatalf("exp glenda by %s, got %s by %q", venti.SecretMethod, th.UID, th.AuthMethod)
+	}
+	// The session should work as usual afterwards.
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without asking, the UID is unverified.
+	c, err = dial(t, l, nil, &venti.ClientConfig{UID: "glenda"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th := <-hellos; th.AuthMethod != "" {
+		t.Fatalf("exp no auth method, got %q", th.AuthMethod)
+	}
+}
+
+func TestSecretAuthFail(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{
+		Auth: venti.Secrets{"glenda": []byte("sesame")},
+	})
+	defer l.Close()
+
+	for _, cfg := range []*venti.ClientConfig{
+		{UID: "glenda", Auth: venti.Secret("open")},
+		{UID: "nobody", Auth: venti.Secret("sesame")},
+	} {
+		if _, err := dial(t, l, nil, cfg); !errors.Is(err, venti.ErrAuth) {
+			t.Fatalf("%s: exp %v, got %v", cfg.UID, venti.ErrAuth, err)
+		}
+	}
+}
+
+// A server has to prove it knows the secret too.
+func TestSecretAuthServer(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{
+		Auth: impostor{venti.Secrets{"glenda": []byte("sesame")}},
+	})
+	defer l.Close()
+
+	_, err := dial(t, l, nil, &venti.ClientConfig{UID: "glenda", Auth: venti.Secret("sesame")})
+	if !errors.Is(err, venti.ErrAuth) {
+		t.Fatalf("exp %v, got %v", venti.ErrAuth, err)
+	}
+}
+
+// Impostor accepts every client, without knowing their secrets.
+type impostor struct {
+	venti.Secrets
+}
+
+func (impostor) Verify(_, _ string, _, _, _, _ []byte) ([]byte, error) {
+	return make([]byte, 32), nil
+}
+
+func TestNoAuthenticator(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{})
+	defer l.Close()
+
+	_, err := dial(t, l, nil, &venti.ClientConfig{UID: "glenda", Auth: venti.Secret("sesame")})
+	if !errors.Is(err, venti.ErrAuth) {
+		t.Fatalf("exp %v, got %v", venti.ErrAuth, err)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package authz decides what each client may do, by the UID it sends in its
+Thello and the address it connects from.
+
+The UID is whatever the client says it is, so this is only as strong as the
+network it's used on; it keeps well-behaved tenants apart, not attackers.
+
+Rules are read from a file, one per line:
+
+	# uid	addr		perms
+	backup	*		rws
+	*	10.1.0.0/16	r
+	*	*		-
+
+A uid is a user name or "*" for anyone; an addr is a CIDR block, an IP
+address, or "*" for anywhere. Perms is any of "r" (read), "w" (write), and "s"
+(sync), or "-" for nothing. The first rule matching a client applies. A
+client that matches no rule, or a rule granting nothing, is refused at the
+handshake.
+*/
+package authz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/hdonnay/venti"
+)
+
+// Perm is a set of operations a client may do.
+type Perm uint8
+
+// These are the Perm bits.
+const (
+	Read Perm = 1 << iota
+	Write
+	Sync
+)
+
+func (p Perm) String() string {
+	if p == 0 {
+		return "-"
+	}
+	b := &strings.Builder{}
+	for i, c := range "rws" {
+		if p&(1<<uint(i)) != 0 {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// ParsePerm parses the perms column of a rule.
+func ParsePerm(s string) (Perm, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	var p Perm
+	for _, c := range s {
+		switch c {
+		case 'r':
+			p |= Read
+		case 'w':
+			p |= Write
+		case 's':
+			p |= Sync
+		default:
+			return 0, fmt.Errorf("bad permission %q", c)
+		}
+	}
+	return p, nil
+}
+
+// Rule grants Perm to a client with the UID connecting from Net. An empty
+// UID or nil Net matches anything.
+type Rule struct {
+	UID  string
+	Net  *net.IPNet
+	Perm Perm
+}
+
+func (r *Rule) match(uid string, ip net.IP) bool {
+	if r.UID != "" && r.UID != uid {
+		return false
+	}
+	return r.Net == nil || (ip != nil && r.Net.Contains(ip))
+}
+
+// Policy is a list of Rules, checked in order.
+type Policy struct {
+	Rules []Rule
+}
+
+// Load reads a Policy from the named file.
+func Load(name string) (*Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// Parse reads a Policy in the format described in the package documentation.
+func Parse(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: want 3 fields, got %d", n, len(f))
+		}
+		var rule Rule
+		if f[0] != "*" {
+			rule.UID = f[0]
+		}
+		if f[1] != "*" {
+			ipn, err := parseNet(f[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			rule.Net = ipn
+		}
+		perm, err := ParsePerm(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rule.Perm = perm
+		p.Rules = append(p.Rules, rule)
+	}
+	return p, sc.Err()
+}
+
+// ParseNet parses a CIDR block, or a single address as a block of one.
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipn, err := net.ParseCIDR(s)
+		return ipn, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Perm returns what the client uid at addr may do. The addr may be nil, in
+// which case only rules for any address match.
+func (p *Policy) Perm(uid string, addr net.Addr) Perm {
+	var ip net.IP
+	if addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	for i := range p.Rules {
+		if p.Rules[i].match(uid, ip) {
+			return p.Rules[i].Perm
+		}
+	}
+	return 0
+}
+
+// Handshake returns a venti.Handshake that refuses clients the Policy grants
+// nothing, and otherwise calls hs and limits the Handler it returns to the
+// client's permissions.
+func (p *Policy) Handshake(hs venti.Handshake) venti.Handshake {
+	return func(th *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+		perm := p.Perm(th.UID, th.Addr)
+		if perm == 0 {
+			return nil, nil, fmt.Errorf("%w: no access for %q from %v", venti.ErrPermission, th.UID, th.Addr)
+		}
+		rh, h, err := hs(th)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rh, Limit(h, th.UID, perm), nil
+	}
+}
+
+// Limit returns a Handler that passes operations allowed by perm to h, and
+// fails the others with an error wrapping venti.ErrPermission. The uid is
+// only used in errors.
+func Limit(h venti.Handler, uid string, perm Perm) venti.Handler {
+	return &limit{h: h, uid: uid, perm: perm}
+}
+
+type limit struct {
+	h    venti.Handler
+	uid  string
+	perm Perm
+}
+
+func (l *limit) deny(op string) error {
+	return fmt.Errorf("%w: %q may not %s", venti.ErrPermission, l.uid, op)
+}
+
+func (l *limit) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	if l.perm&Read == 0 {
+		return nil, l.deny("read")
+	}
+	return l.h.Read(s, k, ct)
+}
+
+// Has needs Read, since it says whether a block exists, as a Read does.
+func (l *limit) Has(s venti.Score, k venti.Type) (bool, error) {
+	if l.perm&Read == 0 {
+		return false, l.deny("read")
+	}
+	return venti.Has(l.h, s, k)
+}
+
+func (l *limit) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	if l.perm&Write == 0 {
+		return nil, l.deny("write")
+	}
+	return l.h.Write(k, r)
+}
+
+func (l *limit) Sync() error {
+	if l.perm&Sync == 0 {
+		return l.deny("sync")
+	}
+	return l.h.Sync()
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package authz
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+const testRules = `
+# uid	addr		perms
+backup	*		rws
+ro	*		r
+*	10.1.0.0/16	r	# the office
+*	192.0.2.7	w
+*	*		-
+`
+
+func TestPerm(t *testing.T) {
+	p, err := Parse(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		uid  string
+		addr net.Addr
+		exp  Perm
+	}{
+		{"backup", nil, Read | Write | Sync},
+		{"ro", &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, Read},
+		{"anonymous", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}, Read},
+		{"anonymous", &net.TCPAddr{IP: net.ParseIP("10.2.0.1")}, 0},
+		{"anonymous", &net.TCPAddr{IP: net.ParseIP("192.0.2.7")}, Write},
+		{"anonymous", nil, 0},
+	}
+	for _, tc := range tt {
+		if got := p.Perm(tc.uid, tc.addr); got != tc.exp {
+			t.Errorf("%s from %v: exp %v, got %v", tc.uid, tc.addr, tc.exp, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"backup rws",
+		"* 10.0.0.0/33 r",
+		"* nowhere r",
+		"* * rwx",
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: wanted an error, didn't get one", in)
+		}
+	}
+}
+
+func dial(t *testing.T, l net.Listener, uid string) (*venti.Client, error) {
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return venti.NewClientConfig(nc, &venti.ClientConfig{UID: uid})
+}
+
+func TestHandshake(t *testing.T) {
+	p, err := Parse(strings.NewReader("writer * rw\nreader * r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go venti.Serve(l, p.Handshake(ventitest.NewMemFS().Handshake))
+
+	w, err := dial(t, l, "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s, err := w.Write(venti.VtData, strings.NewReader("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); !errors.Is(err, venti.ErrPermission) {
+		t.Fatalf("exp %v, got %v", venti.ErrPermission, err)
+	}
+
+	r, err := dial(t, l, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	rc, err := r.Read(venti.VtData, s, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if _, err := r.Write(venti.VtData, strings.NewReader("mine")); !errors.Is(err, venti.ErrPermission) {
+		t.Fatalf("exp %v, got %v", venti.ErrPermission, err)
+	}
+
+	if _, err := dial(t, l, "stranger"); !errors.Is(err, venti.ErrPermission) {
+		t.Fatalf("exp %v, got %v", venti.ErrPermission, err)
+	}
+}
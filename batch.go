@@ -0,0 +1,290 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// A Block is a block to write, for WriteBatch and WriteStream.
+type Block struct {
+	Type Type
+	Data []byte
+}
+
+// A WriteResult is the outcome of writing one block in a WriteStream.
+type WriteResult struct {
+	Score Score
+	Err   error
+}
+
+// A BatchError is the error that stopped a WriteBatch or ReadBatch, and
+// which block it was for.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("venti: batch block %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// WriteStream writes the blocks from in, without waiting for each reply
+// before sending the next write, and sends a result for each on the
+// returned channel, in the order the blocks came in. At most the
+// ClientConfig's Window writes are waiting for replies at once; more blocks
+// aren't taken from in until there's room, or read from the results until
+// they're received.
+//
+// A failed write doesn't stop the rest; cancel ctx for that. Once ctx is
+// done, no more blocks are taken from in, and the channel is closed,
+// possibly before there's a result for every block taken. Otherwise it's
+// closed after in is closed and the last result sent.
+func (c *Client) WriteStream(ctx context.Context, in <-chan Block) <-chan WriteResult {
+	type pending struct {
+		res chan reply
+		err error
+	}
+	out := make(chan WriteResult)
+	sem := make(chan struct{}, c.cfg.Window)
+	q := make(chan pending, c.cfg.Window)
+
+	go func() {
+		defer close(q)
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			var b Block
+			var ok bool
+			select {
+			case b, ok = <-in:
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+			res, err := c.sendWrite(b.Type, bytes.NewReader(b.Data))
+			// Q has room for every write sem lets through.
+			q <- pending{res, err}
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		for p := range q {
+			r := WriteResult{Err: p.err}
+			if p.err == nil {
+				r.Score, r.Err = c.waitWrite(ctx, p.res)
+			}
+			<-sem
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				for p := range q {
+					if p.err == nil {
+						c.waitWrite(ctx, p.res)
+					}
+					<-sem
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// WriteBatch writes bs as WriteStream does, and returns their scores in
+// the same order. It stops at the first failure, returning a *BatchError
+// that says which block failed, and the scores written before it.
+func (c *Client) WriteBatch(ctx context.Context, bs []Block) ([]Score, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	in := make(chan Block)
+	go func() {
+		defer close(in)
+		for _, b := range bs {
+			select {
+			case in <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ss := make([]Score, 0, len(bs))
+	out := c.WriteStream(ctx, in)
+	for r := range out {
+		if r.Err != nil {
+			cancel()
+			for range out {
+			}
+			return ss, &BatchError{Index: len(ss), Err: r.Err}
+		}
+		ss = append(ss, r.Score)
+	}
+	if len(ss) < len(bs) {
+		return ss, &BatchError{Index: len(ss), Err: ctx.Err()}
+	}
+	return ss, nil
+}
+
+// A ReadRequest is a block to read, for ReadBatch and ReadStream. The
+// fields are the arguments to Client.Read.
+type ReadRequest struct {
+	Type  Type
+	Score Score
+	Count int64
+}
+
+// A ReadResult is the outcome of one ReadRequest in a ReadStream. Index is
+// the request's place in the stream, counting from 0.
+type ReadResult struct {
+	Index int
+	Data  []byte
+	Err   error
+}
+
+// ReadStream reads the blocks requested on in, keeping up to the
+// ClientConfig's Window reads in flight, and sends a result for each on the
+// returned channel. If ordered, results come in the order of the requests;
+// otherwise they come as they arrive. It's for prefetching: walking a hash
+// tree, say, while the blocks below are read.
+//
+// Each block is read whole into its result, so replies don't wait on the
+// caller. As with WriteStream, a failed read doesn't stop the rest, and
+// once ctx is done no more requests are taken from in and the channel is
+// closed, possibly before there's a result for every request taken.
+func (c *Client) ReadStream(ctx context.Context, in <-chan ReadRequest, ordered bool) <-chan ReadResult {
+	out := make(chan ReadResult)
+	sem := make(chan struct{}, c.cfg.Window)
+	q := make(chan chan ReadResult, c.cfg.Window)
+	var wg sync.WaitGroup
+
+	go func() {
+		defer func() {
+			if ordered {
+				close(q)
+				return
+			}
+			wg.Wait()
+			close(out)
+		}()
+		for i := 0; ; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			var rq ReadRequest
+			var ok bool
+			select {
+			case rq, ok = <-in:
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+			res, err := c.sendRead(rq.Type, rq.Score, rq.Count)
+			rc := make(chan ReadResult, 1)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r := ReadResult{Index: i, Err: err}
+				if err == nil {
+					r.Data, r.Err = c.readAll(ctx, res)
+				}
+				if rq.Count == 0 {
+					if r.Err = readNone(rq.Score, r.Err); r.Err != nil {
+						r.Data = nil
+					}
+				}
+				if ordered {
+					rc <- r
+					return
+				}
+				select {
+				case out <- r:
+				case <-ctx.Done():
+				}
+				<-sem
+			}(i)
+			if ordered {
+				// Q has room for every read sem lets through.
+				q <- rc
+			}
+		}
+	}()
+
+	if ordered {
+		go func() {
+			defer close(out)
+			for rc := range q {
+				r := <-rc
+				<-sem
+				select {
+				case out <- r:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	return out
+}
+
+// ReadAll waits for the Rread to a sendRead and reads the block.
+func (c *Client) readAll(ctx context.Context, res chan reply) ([]byte, error) {
+	rc, err := c.waitRead(ctx, res)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// ReadBatch reads the blocks in rs as ReadStream does, and returns them in
+// the same order. It stops at the first failure, returning a *BatchError
+// that says which block failed, and the blocks read before it.
+func (c *Client) ReadBatch(ctx context.Context, rs []ReadRequest) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	in := make(chan ReadRequest)
+	go func() {
+		defer close(in)
+		for _, r := range rs {
+			select {
+			case in <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	bs := make([][]byte, 0, len(rs))
+	out := c.ReadStream(ctx, in, true)
+	for r := range out {
+		if r.Err != nil {
+			cancel()
+			for range out {
+			}
+			return bs, &BatchError{Index: r.Index, Err: r.Err}
+		}
+		bs = append(bs, r.Data)
+	}
+	if len(bs) < len(rs) {
+		return bs, &BatchError{Index: len(bs), Err: ctx.Err()}
+	}
+	return bs, nil
+}
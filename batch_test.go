@@ -0,0 +1,431 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// HoldConn is a client connection that can stop reading, so replies pile
+// up unread, and counts the packets written while it's held.
+type holdConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	open   chan struct{}
+	writes int
+}
+
+func (c *holdConn) wrap(nc net.Conn) net.Conn {
+	c.Conn, c.open = nc, make(chan struct{})
+	close(c.open)
+	return c
+}
+
+func (c *holdConn) hold() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open, c.writes = make(chan struct{}), 0
+}
+
+func (c *holdConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.open)
+}
+
+func (c *holdConn) held() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+// Read holds what it's read, rather than holding before reading, so a
+// Read already waiting when hold is called is held too.
+func (c *holdConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	open := c.open
+	c.mu.Unlock()
+	<-open
+	return n, err
+}
+
+func (c *holdConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// BadFS fails writes of the block "bad".
+type badFS struct {
+	*ventitest.MemFS
+}
+
+func (fs badFS) Handshake(*venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, fs, nil
+}
+
+func (fs badFS) Write(t venti.Type, r io.Reader) (venti.Score, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == "bad" {
+		return nil, venti.ErrReadOnly
+	}
+	return fs.MemFS.Write(t, bytes.NewReader(b))
+}
+
+func testBlocks(n int) []venti.Block {
+	bs := make([]venti.Block, n)
+	for i := range bs {
+		bs[i] = venti.Block{Type: venti.VtData, Data: []byte(fmt.Sprintf("block %d", i))}
+	}
+	return bs
+}
+
+// More blocks than there are tags are written, and their scores come back
+// in order.
+func TestWriteBatch(t *testing.T) {
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, nil, &venti.ClientConfig{Window: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := testBlocks(1000)
+	ss, err := c.WriteBatch(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != len(bs) {
+		t.Fatalf("exp %d scores, got %d", len(bs), len(ss))
+	}
+	for i, b := range bs {
+		if exp := sha1.Sum(b.Data); !bytes.Equal(ss[i], exp[:]) {
+			t.Fatalf("block %d: exp %x, got %v", i, exp, ss[i])
+		}
+	}
+}
+
+// Writes are sent without waiting for replies, but no more than the window.
+func TestWriteBatchWindow(t *testing.T) {
+	const window = 8
+	hc := &holdConn{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, hc.wrap, &venti.ClientConfig{Window: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc.hold()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.WriteBatch(context.Background(), testBlocks(100))
+		errc <- err
+	}()
+	for dl := time.Now().Add(5 * time.Second); hc.held() < window; {
+		if time.Now().After(dl) {
+			t.Fatalf("only %d writes sent without replies", hc.held())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := hc.held(); n != window {
+		t.Fatalf("exp %d writes in flight, got %d", window, n)
+	}
+	hc.release()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A batch stops at the first failure, and says where it was.
+func TestWriteBatchError(t *testing.T) {
+	l := listen(t, "localhost:0", badFS{ventitest.NewMemFS()}.Handshake, nil)
+	c, err := dial(t, l, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := testBlocks(50)
+	bs[20].Data = []byte("bad")
+	ss, err := c.WriteBatch(context.Background(), bs)
+	var be *venti.BatchError
+	if !errors.As(err, &be) || be.Index != 20 {
+		t.Fatalf("exp a BatchError for block 20, got %v", err)
+	}
+	if !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp ErrReadOnly, got %v", err)
+	}
+	if len(ss) != 20 {
+		t.Fatalf("exp 20 scores, got %d", len(ss))
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Cancelling a batch stops it waiting, and leaves the client working.
+func TestWriteBatchCancel(t *testing.T) {
+	hc := &holdConn{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, hc.wrap, &venti.ClientConfig{Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc.hold()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.WriteBatch(ctx, testBlocks(100))
+		errc <- err
+	}()
+	for hc.held() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("exp context.Canceled, got %v", err)
+	}
+	hc.release()
+
+	bs := testBlocks(10)
+	ss, err := c.WriteBatch(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range bs {
+		if exp := sha1.Sum(b.Data); !bytes.Equal(ss[i], exp[:]) {
+			t.Fatalf("block %d: exp %x, got %v", i, exp, ss[i])
+		}
+	}
+}
+
+// A stream reports every failure, and carries on past it.
+func TestWriteStream(t *testing.T) {
+	l := listen(t, "localhost:0", badFS{ventitest.NewMemFS()}.Handshake, nil)
+	c, err := dial(t, l, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := testBlocks(30)
+	bs[3].Data, bs[17].Data = []byte("bad"), []byte("bad")
+	in := make(chan venti.Block)
+	go func() {
+		defer close(in)
+		for _, b := range bs {
+			in <- b
+		}
+	}()
+	i := 0
+	for r := range c.WriteStream(context.Background(), in) {
+		switch {
+		case i == 3 || i == 17:
+			if !errors.Is(r.Err, venti.ErrReadOnly) {
+				t.Errorf("block %d: exp ErrReadOnly, got %v", i, r.Err)
+			}
+		case r.Err != nil:
+			t.Errorf("block %d: %v", i, r.Err)
+		default:
+			if exp := sha1.Sum(bs[i].Data); !bytes.Equal(r.Score, exp[:]) {
+				t.Errorf("block %d: exp %x, got %v", i, exp, r.Score)
+			}
+		}
+		i++
+	}
+	if i != len(bs) {
+		t.Fatalf("exp %d results, got %d", len(bs), i)
+	}
+}
+
+func writeBlocks(t *testing.T, c *venti.Client, n int) ([]venti.Block, []venti.ReadRequest) {
+	bs := testBlocks(n)
+	ss, err := c.WriteBatch(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := make([]venti.ReadRequest, n)
+	for i := range rs {
+		rs[i] = venti.ReadRequest{Type: venti.VtData, Score: ss[i], Count: 100}
+	}
+	return bs, rs
+}
+
+// More blocks than there are tags are read, and come back in order.
+func TestReadBatch(t *testing.T) {
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, nil, &venti.ClientConfig{Window: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, rs := writeBlocks(t, c, 1000)
+
+	got, err := c.ReadBatch(context.Background(), rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(bs) {
+		t.Fatalf("exp %d blocks, got %d", len(bs), len(got))
+	}
+	for i, b := range bs {
+		if !bytes.Equal(got[i], b.Data) {
+			t.Fatalf("block %d: exp %q, got %q", i, b.Data, got[i])
+		}
+	}
+}
+
+// Reads are sent without waiting for replies, but no more than the window.
+func TestReadBatchWindow(t *testing.T) {
+	const window = 8
+	hc := &holdConn{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, hc.wrap, &venti.ClientConfig{Window: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rs := writeBlocks(t, c, 100)
+
+	hc.hold()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.ReadBatch(context.Background(), rs)
+		errc <- err
+	}()
+	for dl := time.Now().Add(5 * time.Second); hc.held() < window; {
+		if time.Now().After(dl) {
+			t.Fatalf("only %d reads sent without replies", hc.held())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := hc.held(); n != window {
+		t.Fatalf("exp %d reads in flight, got %d", window, n)
+	}
+	hc.release()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A batch stops at the first failure, and says where it was.
+func TestReadBatchError(t *testing.T) {
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rs := writeBlocks(t, c, 50)
+
+	rs[20].Score = make(venti.Score, 20)
+	got, err := c.ReadBatch(context.Background(), rs)
+	var be *venti.BatchError
+	if !errors.As(err, &be) || be.Index != 20 {
+		t.Fatalf("exp a BatchError for block 20, got %v", err)
+	}
+	if !errors.Is(err, venti.ErrNotFound) {
+		t.Fatalf("exp ErrNotFound, got %v", err)
+	}
+	if len(got) != 20 {
+		t.Fatalf("exp 20 blocks, got %d", len(got))
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Cancelling a batch stops it waiting, and the replies it leaves behind
+// don't hold up the connection.
+func TestReadBatchCancel(t *testing.T) {
+	hc := &holdConn{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, hc.wrap, &venti.ClientConfig{Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, rs := writeBlocks(t, c, 100)
+
+	hc.hold()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.ReadBatch(ctx, rs)
+		errc <- err
+	}()
+	for hc.held() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("exp context.Canceled, got %v", err)
+	}
+	hc.release()
+
+	got, err := c.ReadBatch(context.Background(), rs[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], bs[i].Data) {
+			t.Fatalf("block %d: exp %q, got %q", i, bs[i].Data, got[i])
+		}
+	}
+}
+
+// An unordered stream returns every block once, failures included.
+func TestReadStreamUnordered(t *testing.T) {
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, nil)
+	c, err := dial(t, l, nil, &venti.ClientConfig{Window: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, rs := writeBlocks(t, c, 200)
+
+	rs[7].Type = venti.VtDir
+	in := make(chan venti.ReadRequest)
+	go func() {
+		defer close(in)
+		for _, r := range rs {
+			in <- r
+		}
+	}()
+	seen := make(map[int]bool)
+	for r := range c.ReadStream(context.Background(), in, false) {
+		if seen[r.Index] {
+			t.Fatalf("block %d twice", r.Index)
+		}
+		seen[r.Index] = true
+		switch {
+		case r.Index == 7:
+			if !errors.Is(r.Err, venti.ErrTypeMismatch) {
+				t.Errorf("block 7: exp ErrTypeMismatch, got %v", r.Err)
+			}
+		case r.Err != nil:
+			t.Errorf("block %d: %v", r.Index, r.Err)
+		case !bytes.Equal(r.Data, bs[r.Index].Data):
+			t.Errorf("block %d: exp %q, got %q", r.Index, bs[r.Index].Data, r.Data)
+		}
+	}
+	if len(seen) != len(rs) {
+		t.Fatalf("exp %d results, got %d", len(rs), len(seen))
+	}
+}
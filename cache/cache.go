@@ -0,0 +1,186 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package cache is a venti.Handler that keeps recently read blocks in memory.
+
+Blocks are content-addressed, so a cached block never goes stale; the only
+question is what to throw out when the cache is full. The least-recently used
+block goes first.
+*/
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/hdonnay/venti"
+)
+
+// Stats is a snapshot of a Cache's counters.
+type Stats struct {
+	Hits, Misses uint64
+	// Blocks and Bytes are how much is currently cached.
+	Blocks int
+	Bytes  int64
+}
+
+// Cache wraps a venti.Handler, serving reads out of memory when it can.
+type Cache struct {
+	h   venti.Handler
+	max int64
+
+	// FillOnWrite controls whether written blocks are added to the cache. It
+	// should be set before the Cache is used.
+	FillOnWrite bool
+
+	mu    *sync.Mutex
+	lru   *list.List
+	block map[key]*list.Element
+	stats Stats
+}
+
+type key struct {
+	score string
+	kind  venti.Type
+}
+
+type entry struct {
+	key
+	data []byte
+}
+
+// New returns a Cache in front of h that holds at most max bytes of block
+// data.
+func New(h venti.Handler, max int64) *Cache {
+	return &Cache{
+		h:     h,
+		max:   max,
+		mu:    &sync.Mutex{},
+		lru:   list.New(),
+		block: make(map[key]*list.Element),
+	}
+}
+
+// Handshake is a venti.Handshake that serves every client from c.
+func (c *Cache) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, c, nil
+}
+
+// Stats reports the Cache's counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Read serves the block from memory if it's cached and fits in ct, and from
+// the wrapped Handler otherwise. Only whole blocks are kept, so a read cut
+// short by its count isn't served to later ones.
+func (c *Cache) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	if b, ok := c.get(key{string(s), k}, ct); ok {
+		return bytes.NewReader(b), nil
+	}
+
+	r, err := c.h.Read(s, k, ct)
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if complete(s, b) {
+		c.put(key{string(s), k}, b)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// Complete reports whether b is all of the block with score s, rather than
+// some of it cut short by a count.
+func complete(s venti.Score, b []byte) bool {
+	sum := sha1.Sum(b)
+	return bytes.Equal(sum[:], s)
+}
+
+// Has reports whether the block is cached, and asks the wrapped Handler if
+// it isn't. It doesn't change the counters.
+func (c *Cache) Has(s venti.Score, k venti.Type) (bool, error) {
+	c.mu.Lock()
+	_, ok := c.block[key{string(s), k}]
+	c.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return venti.Has(c.h, s, k)
+}
+
+// Write passes the block through to the wrapped Handler, keeping a copy if
+// FillOnWrite is set.
+func (c *Cache) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	if !c.FillOnWrite {
+		return c.h.Write(k, r)
+	}
+	buf := &bytes.Buffer{}
+	s, err := c.h.Write(k, io.TeeReader(r, buf))
+	if err != nil {
+		return s, err
+	}
+	c.put(key{string(s), k}, buf.Bytes())
+	return s, nil
+}
+
+// Sync calls Sync on the wrapped Handler.
+func (c *Cache) Sync() error {
+	return c.h.Sync()
+}
+
+// Get returns the cached block k, if it's no bigger than ct.
+func (c *Cache) get(k key, ct int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.block[k]
+	if !ok || int64(len(e.Value.(*entry).data)) > ct {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*entry).data, true
+}
+
+func (c *Cache) put(k key, b []byte) {
+	sz := int64(len(b))
+	if sz > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.block[k]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	for c.stats.Bytes+sz > c.max {
+		c.evict()
+	}
+	c.block[k] = c.lru.PushFront(&entry{key: k, data: b})
+	c.stats.Blocks++
+	c.stats.Bytes += sz
+}
+
+// Evict drops the least-recently used block. The caller must hold the lock.
+func (c *Cache) evict() {
+	e := c.lru.Back()
+	ent := c.lru.Remove(e).(*entry)
+	delete(c.block, ent.key)
+	c.stats.Blocks--
+	c.stats.Bytes -= int64(len(ent.data))
+}
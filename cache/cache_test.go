@@ -0,0 +1,195 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/proxy"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func TestHandler(t *testing.T) {
+	c := New(ventitest.NewMemFS(), 1<<16)
+	ventitest.TestHandler(t, c)
+
+	c = New(ventitest.NewMemFS(), 1<<16)
+	c.FillOnWrite = true
+	ventitest.TestHandler(t, c)
+}
+
+func read(t *testing.T, c *Cache, s venti.Score) []byte {
+	r, err := c.Read(s, venti.VtData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEvict(t *testing.T) {
+	c := New(ventitest.NewMemFS(), 2048)
+	var scs []venti.Score
+	for i := 0; i < 3; i++ {
+		s, err := c.Write(venti.VtData, bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 1024)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scs = append(scs, s)
+	}
+
+	read(t, c, scs[0]) // miss
+	read(t, c, scs[1]) // miss
+	read(t, c, scs[0]) // hit
+	read(t, c, scs[2]) // miss, evicts 1
+	read(t, c, scs[0]) // hit
+	read(t, c, scs[1]) // miss, evicts 2
+
+	exp := Stats{Hits: 2, Misses: 4, Blocks: 2, Bytes: 2048}
+	if got := c.Stats(); got != exp {
+		t.Fatalf("exp %+v, got %+v", exp, got)
+	}
+}
+
+func TestFillOnWrite(t *testing.T) {
+	fs := &countFS{MemFS: ventitest.NewMemFS()}
+	c := New(fs, 4096)
+	c.FillOnWrite = true
+	b := []byte("fill on write")
+	s, err := c.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, c, s); !bytes.Equal(b, got) {
+		t.Fatalf("exp %q, got %q", b, got)
+	}
+	if st := c.Stats(); st.Hits != 1 || st.Misses != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if n := fs.reads; n != 0 {
+		t.Fatalf("exp no backend reads, got %d", n)
+	}
+	// A count smaller than the block skips the cache.
+	if _, err := c.Read(s, venti.VtData, 1); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.Misses != 1 || fs.reads != 1 {
+		t.Fatalf("exp a miss and a backend read, got %+v and %d", st, fs.reads)
+	}
+}
+
+// CountFS counts reads, and cuts blocks short at the count, as a server
+// enforcing counts would.
+type countFS struct {
+	*ventitest.MemFS
+	reads int
+}
+
+func (fs *countFS) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	fs.reads++
+	r, err := fs.MemFS.Read(s, k, ct)
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, ct), nil
+}
+
+// A short read isn't cached, so it's not served to a read wanting the
+// whole block.
+func TestShortRead(t *testing.T) {
+	fs := &countFS{MemFS: ventitest.NewMemFS()}
+	c := New(fs, 4096)
+	b := []byte("cut short")
+	s, err := c.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Read(s, venti.VtData, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, b[:3]) {
+		t.Fatalf("exp %q, got %q", b[:3], got)
+	}
+	if got := read(t, c, s); !bytes.Equal(got, b) {
+		t.Fatalf("exp %q, got %q", b, got)
+	}
+	if got := read(t, c, s); !bytes.Equal(got, b) {
+		t.Fatalf("exp %q, got %q", b, got)
+	}
+	if fs.reads != 2 {
+		t.Fatalf("exp 2 backend reads, got %d", fs.reads)
+	}
+	if st := c.Stats(); st.Blocks != 1 || st.Hits != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+// In front of a proxy, Has is asked upstream and a read with a count of 0
+// fails as too big, so neither leaves an empty block in the cache.
+func TestOverProxy(t *testing.T) {
+	ul, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	go venti.Serve(ul, ventitest.NewMemFS().Handshake)
+	p, err := proxy.Dial([]string{ul.Addr().String()}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	c := New(p, 4096)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go venti.Serve(l, c.Handshake)
+	cl, err := venti.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	b := []byte("over a proxy")
+	s, err := cl.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []venti.Type{venti.VtData, venti.VtDir} {
+		ok, err := cl.Has(context.Background(), s, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (k == venti.VtData) {
+			t.Errorf("Has as type %d: got %v", k, ok)
+		}
+	}
+	if _, err := c.Read(s, venti.VtData, 0); !errors.Is(err, venti.ErrTooBig) {
+		t.Fatalf("exp %v, got %v", venti.ErrTooBig, err)
+	}
+	if st := c.Stats(); st.Blocks != 0 {
+		t.Fatalf("exp nothing cached, got %+v", st)
+	}
+	if got := read(t, c, s); !bytes.Equal(got, b) {
+		t.Fatalf("exp %q, got %q", b, got)
+	}
+	if st := c.Stats(); st.Blocks != 1 || st.Bytes != int64(len(b)) {
+		t.Fatalf("exp the block cached, got %+v", st)
+	}
+}
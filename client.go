@@ -6,6 +6,9 @@ package venti
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,6 +19,8 @@ import (
 	"github.com/hdonnay/venti/internal/pack"
 )
 
+// Dial connects to the venti server at the TCP address addr. DialAddr takes
+// dial strings, for other networks.
 func Dial(addr string) (*Client, error) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -24,15 +29,72 @@ func Dial(addr string) (*Client, error) {
 	return NewClient(conn)
 }
 
+// ClientConfig is the settings for a Client's session.
+type ClientConfig struct {
+	// UID is the user name sent in the hello. If empty, "anonymous" is
+	// used. Servers may use it to decide what the client can do, but
+	// nothing checks it's true.
+	UID string
+
+	// Auth, if set, proves to the server that the client is UID. See
+	// StrengthAuth.
+	Auth ClientAuth
+
+	// Codecs are the codecs to offer the server, most preferred first. If
+	// empty, the session isn't compressed.
+	Codecs []uint8
+
+	// Crypto are the encryption schemes to offer the server, most
+	// preferred first. Offering any needs an Auth that's a KeyedAuth. A
+	// server may not encrypt the session anyway; check Client.Crypto.
+	Crypto []uint8
+
+	// RequireCrypto fails the hello if the server doesn't encrypt the
+	// session.
+	RequireCrypto bool
+
+	// Window is the most requests a WriteStream, WriteBatch, ReadStream,
+	// or ReadBatch keeps waiting for replies at once. If zero, 64; it
+	// can't be more than 256, the number of tags.
+	Window int
+}
+
 func NewClient(conn net.Conn) (*Client, error) {
+	return NewClientConfig(conn, nil)
+}
+
+// NewClientConfig is like NewClient, but uses the settings in cfg. A nil cfg
+// is the same as the zero ClientConfig.
+func NewClientConfig(conn net.Conn, cfg *ClientConfig) (*Client, error) {
+	if cfg == nil {
+		cfg = &ClientConfig{}
+	}
 	c := &Client{
 		Conn: conn,
+		cfg:  *cfg,
 		w:    pack.Chunk(conn),
 		r:    pack.Dechunk(conn),
 		done: make(chan struct{}),
 
 		ts: &tagset{},
 	}
+	if c.cfg.UID == "" {
+		c.cfg.UID = "anonymous"
+	}
+	if c.cfg.Window <= 0 {
+		c.cfg.Window = 64
+	}
+	if c.cfg.Window > 256 {
+		c.cfg.Window = 256
+	}
+	if _, ok := c.cfg.Auth.(KeyedAuth); len(c.cfg.Crypto) != 0 && !ok {
+		conn.Close()
+		return nil, fmt.Errorf("venti: offering crypto needs a KeyedAuth")
+	}
+	if c.cfg.RequireCrypto && len(c.cfg.Crypto) == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("venti: requiring crypto needs some offered")
+	}
 	//c.w.Chatty = true
 	//c.r.Chatty = true
 	var err error
@@ -56,11 +118,18 @@ type Client struct {
 	r    *pack.Dechunker
 	done chan struct{}
 	pool sync.Pool
-	err  error
+	cfg  ClientConfig
+
+	// Err is why the connection stopped, once it has.
+	errMu     sync.Mutex
+	err       error
+	closeOnce sync.Once
 
 	ts *tagset
 
 	Version string
+	// Crypto is the encryption scheme the server chose, or CryptoNone.
+	Crypto uint8
 }
 
 func (c *Client) recv() {
@@ -70,22 +139,82 @@ func (c *Client) recv() {
 			return
 		default:
 		}
+		var hdr [2]byte
+		n, err := io.ReadFull(c.r, hdr[:])
+		switch {
+		case err == io.EOF, err == io.ErrUnexpectedEOF && n != 0:
+			// An empty or runt packet. If it was the connection ending
+			// instead, the next read says so.
+			continue
+		case err != nil:
+			c.fail(err)
+			return
+		}
+		tag := hdr[1]
+
+		// Rreads are streamed: the caller reads the block straight off the
+		// connection, and nothing else is read until it's done.
+		if hdr[0] == msg.KindRread {
+			buf := c.newBuf()
+			buf.Write(hdr[:1])
+			b := newBody(c.r)
+			if !c.ts.Send(tag, reply{buf, b}) {
+				c.doneBuf(buf)
+				b.Close()
+			}
+			select {
+			case <-b.Done():
+			case <-c.done:
+				return
+			}
+			if b.err != io.EOF {
+				c.fail(b.err)
+				return
+			}
+			continue
+		}
+
 		buf := c.newBuf()
-		n, err := io.Copy(buf, c.r)
-		if err != nil {
-			c.err = err
+		buf.Write(hdr[:])
+		if _, err := io.Copy(buf, c.r); err != nil {
+			c.fail(err)
 			return
 		}
-		if n == 0 {
+		if !c.ts.Send(tag, reply{Buffer: buf}) {
 			c.doneBuf(buf)
-			continue
 		}
-		tag := buf.Bytes()[1]
-		// Send is a channel send and clunk
-		c.ts.Send(tag, buf)
 	}
 }
 
+var errClientClosed = fmt.Errorf("venti: client closed")
+
+// Fail records why the connection stopped and wakes everything waiting on
+// a reply.
+func (c *Client) fail(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+	c.ts.Fail()
+}
+
+// Err returns the error that stopped the connection, or nil if it's still
+// working. A Client with an error fails every call.
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Closed is the error for a reply that never came.
+func (c *Client) closed() error {
+	if err := c.Err(); err != nil {
+		return fmt.Errorf("connection closed: %w", err)
+	}
+	return fmt.Errorf("connection closed")
+}
+
 func (c *Client) version() (string, error) {
 	buf := &bytes.Buffer{}
 	fmt.Fprintf(buf, "venti-%s-%s\n", strings.Join(vers, ":"), verComment)
@@ -122,7 +251,12 @@ func (c *Client) hello() error {
 	t := &msg.Thello{
 		Tag:     tag,
 		Version: c.Version,
-		UID:     "anonymous",
+		UID:     c.cfg.UID,
+		Codec:   c.cfg.Codecs,
+		Crypto:  c.cfg.Crypto,
+	}
+	if c.cfg.Auth != nil {
+		t.Strong |= StrengthAuth
 	}
 	w := c.w.New()
 	if _, err := io.Copy(w, t); err != nil {
@@ -130,7 +264,20 @@ func (c *Client) hello() error {
 	}
 	w.Close()
 
-	buf := <-r
+	var key []byte
+	if c.cfg.Auth != nil {
+		var err error
+		if key, err = c.auth(helloOffers(t.Strong, t.Crypto, t.Codec)); err != nil {
+			c.ts.Clunk(tag)
+			return err
+		}
+	}
+
+	rp, ok := <-r
+	if !ok {
+		return c.closed()
+	}
+	buf := rp.Buffer
 	defer c.doneBuf(buf)
 
 	if err := want(msg.KindRhello, buf); err != nil {
@@ -140,11 +287,88 @@ func (c *Client) hello() error {
 	if _, err := io.Copy(h, buf); err != nil {
 		return err
 	}
-	// if negotiating stuff, do that here.
+	if h.Codec != CodecNone {
+		nf, ok := codecs[h.Codec]
+		if !ok || !bytes.Contains(c.cfg.Codecs, []byte{h.Codec}) {
+			return fmt.Errorf("server chose codec %d, which wasn't offered", h.Codec)
+		}
+		f := nf()
+		c.w.Push(f)
+		c.r.Push(f)
+	}
+	if h.Crypto != CryptoNone {
+		if key == nil || !bytes.Contains(c.cfg.Crypto, []byte{h.Crypto}) {
+			return fmt.Errorf("server chose crypto %d, which wasn't offered", h.Crypto)
+		}
+		send, recv, err := cryptoFilters(h.Crypto, key, true)
+		if err != nil {
+			return err
+		}
+		c.w.Push(send)
+		c.r.Push(recv)
+		c.Crypto = h.Crypto
+	}
+	if c.cfg.RequireCrypto && c.Crypto == CryptoNone {
+		return fmt.Errorf("server didn't encrypt the session")
+	}
 
 	return nil
 }
 
+// Auth runs the client side of the exchange between Thello and Rhello,
+// returning the session key if the ClientAuth is a KeyedAuth.
+func (c *Client) auth(hello []byte) ([]byte, error) {
+	a, uid := c.cfg.Auth, c.cfg.UID
+	t0, err := a.Start(uid)
+	if err != nil {
+		return nil, err
+	}
+	r0 := &msg.Rauth0{}
+	tag, res := c.ts.New()
+	if err := c.rpc(&msg.Tauth0{Tag: tag, Method: a.Method(), Data: t0}, tag, res, msg.KindRauth0, r0); err != nil {
+		return nil, err
+	}
+	t1, err := a.Respond(uid, hello, t0, r0.Data)
+	if err != nil {
+		return nil, err
+	}
+	r1 := &msg.Rauth1{}
+	tag, res = c.ts.New()
+	if err := c.rpc(&msg.Tauth1{Tag: tag, Data: t1}, tag, res, msg.KindRauth1, r1); err != nil {
+		return nil, err
+	}
+	if err := a.Check(uid, hello, t0, r0.Data, t1, r1.Data); err != nil {
+		return nil, err
+	}
+	if ka, ok := a.(KeyedAuth); ok {
+		return ka.SessionKey(uid, t0, r0.Data, t1)
+	}
+	return nil, nil
+}
+
+// Rpc sends t, which uses tag, and reads the reply of kind k into r. The
+// reply's data is copied out of the packet.
+func (c *Client) rpc(t io.Reader, tag uint8, res chan reply, k byte, r io.Writer) error {
+	w := c.w.New()
+	if _, err := io.Copy(w, t); err != nil {
+		c.ts.Clunk(tag)
+		return err
+	}
+	w.Close()
+
+	rp, ok := <-res
+	if !ok {
+		return c.closed()
+	}
+	buf := rp.Buffer
+	defer c.doneBuf(buf)
+	if err := want(k, buf); err != nil {
+		return err
+	}
+	_, err := r.Write(append([]byte(nil), buf.Bytes()...))
+	return err
+}
+
 func (c *Client) goodbye() error {
 	// we never get a response, the tags doesn't matter
 	t := &msg.Tgoodbye{Tag: 0x42}
@@ -156,9 +380,44 @@ func (c *Client) goodbye() error {
 	return nil
 }
 
+// Read reads the block with score s and type t, of at most ct bytes.
+//
+// The block is read straight off the connection as the caller reads it.
+// Replies to other requests wait until it's been read to the end or
+// closed, so it must always be one or the other.
 func (c *Client) Read(t Type, s Score, ct int64) (io.ReadCloser, error) {
-	if c.err != nil {
-		return nil, c.err
+	res, err := c.sendRead(t, s, ct)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.waitRead(context.Background(), res)
+	if ct == 0 {
+		if err = readNone(s, err); err != nil && rc != nil {
+			rc.Close()
+			rc = nil
+		}
+	}
+	return rc, err
+}
+
+// EmptyScore is the score of the empty block.
+var emptyScore = Score(sha1.New().Sum(nil))
+
+// ReadNone fixes up the reply to a Tread with a count of 0. Servers here
+// take it for a Has, and send nothing for a block that exists, so it's
+// turned back into what a read gets: the empty block, or ErrTooBig for any
+// other.
+func readNone(s Score, err error) error {
+	if err == nil && !bytes.Equal(s, emptyScore) {
+		return fmt.Errorf("%w: %v is bigger than a count of 0", ErrTooBig, s)
+	}
+	return err
+}
+
+// SendRead sends a Tread, returning where its reply will come.
+func (c *Client) sendRead(t Type, s Score, ct int64) (chan reply, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
 	}
 	if ct < 0 {
 		return nil, fmt.Errorf("bad count")
@@ -176,21 +435,84 @@ func (c *Client) Read(t Type, s Score, ct int64) (io.ReadCloser, error) {
 		c.ts.Clunk(tag)
 		return nil, err
 	}
-	w.Close()
+	if err := w.Close(); err != nil {
+		c.ts.Clunk(tag)
+		return nil, err
+	}
+	return res, nil
+}
 
-	buf := <-res
-	// can't defer putting the buffer back automatically
+// WaitRead waits for the Rread to a sendRead. If ctx is done first, the
+// reply is read and dropped when it comes, as it has to be.
+func (c *Client) waitRead(ctx context.Context, res chan reply) (io.ReadCloser, error) {
+	var rp reply
+	var ok bool
+	select {
+	case rp, ok = <-res:
+	case <-ctx.Done():
+		go func() {
+			if rp, ok := <-res; ok {
+				if rp.body != nil {
+					rp.body.Close()
+				}
+				c.doneBuf(rp.Buffer)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if !ok {
+		return nil, c.closed()
+	}
+	buf := rp.Buffer
+	defer c.doneBuf(buf)
 	if err := want(msg.KindRread, buf); err != nil {
+		if rp.body != nil {
+			rp.body.Close()
+		}
 		return nil, err
 	}
-	buf.Next(1) // discard the tag
+	if rp.body == nil {
+		return nil, fmt.Errorf("incoming message: Rread wasn't streamed")
+	}
+	return rp.body, nil
+}
 
-	return poolCloser(c, buf), nil
+// Has reports whether the server has the block with score s and type t,
+// without reading it: it's a Tread with a count of 0, which servers here
+// answer with venti.Has.
+//
+// Other servers may send the block anyway, which is read and thrown away,
+// or refuse the count as too small, as plan9port's venti does, which means
+// they have it.
+func (c *Client) Has(ctx context.Context, s Score, t Type) (bool, error) {
+	res, err := c.sendRead(t, s, 0)
+	if err != nil {
+		return false, err
+	}
+	rc, err := c.waitRead(ctx, res)
+	switch {
+	case errors.Is(err, ErrTooBig):
+		return true, nil
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrTypeMismatch):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, rc.Close()
 }
 
 func (c *Client) Write(t Type, r io.Reader) (Score, error) {
-	if c.err != nil {
-		return nil, c.err
+	res, err := c.sendWrite(t, r)
+	if err != nil {
+		return nil, err
+	}
+	return c.waitWrite(context.Background(), res)
+}
+
+// SendWrite sends a Twrite, returning where its reply will come.
+func (c *Client) sendWrite(t Type, r io.Reader) (chan reply, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
 	}
 	tag, res := c.ts.New()
 	tw := &msg.Twrite{
@@ -207,9 +529,33 @@ func (c *Client) Write(t Type, r io.Reader) (Score, error) {
 		c.ts.Clunk(tag)
 		return nil, err
 	}
-	w.Close()
+	if err := w.Close(); err != nil {
+		c.ts.Clunk(tag)
+		return nil, err
+	}
+	return res, nil
+}
 
-	buf := <-res
+// WaitWrite waits for the Rwrite to a sendWrite. If ctx is done first, the
+// reply is dropped when it comes; the tag stays in use until then, so it
+// can't be mistaken for the reply to a later request.
+func (c *Client) waitWrite(ctx context.Context, res chan reply) (Score, error) {
+	var rp reply
+	var ok bool
+	select {
+	case rp, ok = <-res:
+	case <-ctx.Done():
+		go func() {
+			if rp, ok := <-res; ok {
+				c.doneBuf(rp.Buffer)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if !ok {
+		return nil, c.closed()
+	}
+	buf := rp.Buffer
 	defer c.doneBuf(buf)
 	if err := want(msg.KindRwrite, buf); err != nil {
 		return nil, err
@@ -223,8 +569,8 @@ func (c *Client) Write(t Type, r io.Reader) (Score, error) {
 }
 
 func (c *Client) Ping() error {
-	if c.err != nil {
-		return c.err
+	if err := c.Err(); err != nil {
+		return err
 	}
 	tag, r := c.ts.New()
 
@@ -236,7 +582,11 @@ func (c *Client) Ping() error {
 	}
 	w.Close()
 
-	buf := <-r
+	rp, ok := <-r
+	if !ok {
+		return c.closed()
+	}
+	buf := rp.Buffer
 	defer c.doneBuf(buf)
 
 	if err := want(msg.KindRping, buf); err != nil {
@@ -247,8 +597,8 @@ func (c *Client) Ping() error {
 }
 
 func (c *Client) Sync() error {
-	if c.err != nil {
-		return c.err
+	if err := c.Err(); err != nil {
+		return err
 	}
 	tag, r := c.ts.New()
 
@@ -260,7 +610,11 @@ func (c *Client) Sync() error {
 	}
 	w.Close()
 
-	buf := <-r
+	rp, ok := <-r
+	if !ok {
+		return c.closed()
+	}
+	buf := rp.Buffer
 	defer c.doneBuf(buf)
 
 	if err := want(msg.KindRsync, buf); err != nil {
@@ -270,10 +624,43 @@ func (c *Client) Sync() error {
 	return nil
 }
 
+// Handler returns a Handler that forwards every operation to the server c is
+// connected to.
+func (c *Client) Handler() Handler {
+	return clientHandler{c}
+}
+
+type clientHandler struct {
+	c *Client
+}
+
+func (h clientHandler) Read(s Score, t Type, ct int64) (io.Reader, error) {
+	return h.c.Read(t, s, ct)
+}
+
+func (h clientHandler) Write(t Type, r io.Reader) (Score, error) {
+	return h.c.Write(t, r)
+}
+
+func (h clientHandler) Has(s Score, t Type) (bool, error) {
+	return h.c.Has(context.Background(), s, t)
+}
+
+func (h clientHandler) Sync() error {
+	return h.c.Sync()
+}
+
+// Close says goodbye and closes the connection. Closing a Client twice is
+// harmless.
 func (c *Client) Close() error {
-	c.goodbye()
-	close(c.done)
-	return c.Conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		c.goodbye()
+		close(c.done)
+		err = c.Conn.Close()
+		c.fail(errClientClosed)
+	})
+	return err
 }
 
 func (c *Client) newBuf() *bytes.Buffer {
@@ -289,28 +676,69 @@ func (c *Client) doneBuf(b *bytes.Buffer) {
 
 type tagset struct {
 	sync.Mutex
-	next uint8
-	wait [256]chan *bytes.Buffer
+	next   uint8
+	wait   [256]chan reply
+	failed bool
+	free   *sync.Cond // Signalled when a tag is freed.
+}
+
+// Release frees tag tg. The lock must be held.
+func (t *tagset) release(tg uint8) {
+	close(t.wait[tg])
+	t.wait[tg] = nil
+	if t.free != nil {
+		t.free.Signal()
+	}
+}
+
+// New returns a free tag and the channel its reply will come on. If all
+// 256 are in use, it waits for one.
+func (t *tagset) New() (uint8, chan reply) {
+	t.Lock()
+	defer t.Unlock()
+	if t.free == nil {
+		t.free = sync.NewCond(&t.Mutex)
+	}
+	for {
+		if t.failed {
+			ch := make(chan reply)
+			close(ch)
+			return 0, ch
+		}
+		// The Plan 9 libventi is a stickler for the client to start at
+		// 0x00, which seems like it shouldn't matter?
+		for i := 0; i < len(t.wait); i++ {
+			tg := t.next
+			t.next++
+			if t.wait[tg] == nil {
+				// Buffered, so Send never waits on a caller that's given up.
+				ch := make(chan reply, 1)
+				t.wait[tg] = ch
+				return tg, ch
+			}
+		}
+		t.free.Wait()
+	}
 }
 
-func (t *tagset) New() (uint8, chan *bytes.Buffer) {
-	// There might be a problem if we attempt more than 256 requests in-flight
+// Fail wakes everything waiting on a tag with a closed channel, and makes
+// New hand out closed channels from then on.
+func (t *tagset) Fail() {
 	t.Lock()
 	defer t.Unlock()
-	// The Plan 9 libventi is a stickler for the client to start at 0x00, which
-	// seems like it shouldn't matter?
-	lp := t.next - 1
-	for ; t.next != lp; t.next++ {
-		if t.wait[t.next] == nil {
-			ch := make(chan *bytes.Buffer)
-			t.wait[t.next] = ch
-			return t.next, ch
+	t.failed = true
+	for i, ch := range t.wait {
+		if ch != nil {
+			close(ch)
+			t.wait[i] = nil
 		}
 	}
-	panic("too many concurrent requests") // time to rewrite this if you're here
+	if t.free != nil {
+		t.free.Broadcast()
+	}
 }
 
-func (t *tagset) Tag(tg uint8) chan *bytes.Buffer {
+func (t *tagset) Tag(tg uint8) chan reply {
 	t.Lock()
 	defer t.Unlock()
 	return t.wait[tg]
@@ -319,16 +747,29 @@ func (t *tagset) Tag(tg uint8) chan *bytes.Buffer {
 func (t *tagset) Clunk(tg uint8) {
 	t.Lock()
 	defer t.Unlock()
-	close(t.wait[tg])
-	t.wait[tg] = nil
+	if t.wait[tg] != nil {
+		t.release(tg)
+	}
 }
 
-func (t *tagset) Send(tg uint8, buf *bytes.Buffer) {
+// Send hands rp to whoever is waiting on the tag, reporting whether anyone
+// was. A reply for a tag nobody is waiting on is dropped.
+func (t *tagset) Send(tg uint8, rp reply) bool {
 	t.Lock()
 	defer t.Unlock()
-	t.wait[tg] <- buf
-	close(t.wait[tg])
-	t.wait[tg] = nil
+	if t.wait[tg] == nil {
+		return false
+	}
+	t.wait[tg] <- rp
+	t.release(tg)
+	return true
+}
+
+// A reply is what recv hands the caller waiting on a tag: the packet, or
+// for a streamed Rread, its kind and the body still to be read.
+type reply struct {
+	*bytes.Buffer
+	body *body
 }
 
 func want(w byte, buf *bytes.Buffer) error {
@@ -337,7 +778,7 @@ func want(w byte, buf *bytes.Buffer) error {
 	case msg.KindRerror:
 		r := &msg.Rerror{}
 		io.Copy(r, buf)
-		return r
+		return &ServerError{Msg: r.Err}
 	case w:
 		break
 	default:
@@ -345,17 +786,3 @@ func want(w byte, buf *bytes.Buffer) error {
 	}
 	return nil
 }
-
-func poolCloser(c *Client, buf *bytes.Buffer) io.ReadCloser {
-	return &pc{*buf, c}
-}
-
-type pc struct {
-	bytes.Buffer
-	c *Client
-}
-
-func (pc *pc) Close() error {
-	pc.c.doneBuf(&pc.Buffer)
-	return nil
-}
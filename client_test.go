@@ -7,7 +7,11 @@ package venti_test
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"strings"
 	"testing"
 
 	"github.com/hdonnay/venti"
@@ -118,3 +122,115 @@ func TestSyncFail(t *testing.T) {
 	}
 	t.Log(err)
 }
+
+// An error from the Handler is reported to the client, and the connection
+// carries on.
+func TestHandlerErrorKeepsConn(t *testing.T) {
+	c, done := startServer(t, errs.Handshake)
+	defer done()
+
+	ops := []func() error{
+		func() error {
+			_, err := c.Read(venti.VtData, make(venti.Score, 20), 64)
+			return err
+		},
+		func() error {
+			_, err := c.Write(venti.VtData, bytes.NewReader([]byte("block")))
+			return err
+		},
+		c.Sync,
+	}
+	for i, op := range ops {
+		if err := op(); err == nil || !strings.Contains(err.Error(), errStr) {
+			t.Fatalf("op %d: exp %q, got %v", i, errStr, err)
+		}
+		if err := c.Ping(); err != nil {
+			t.Fatalf("op %d: ping after error: %v", i, err)
+		}
+	}
+}
+
+func TestClientHandler(t *testing.T) {
+	c, done := startServer(t, ventitest.NewMemFS().Handshake)
+	defer done()
+
+	ventitest.TestHandler(t, c.Handler())
+}
+
+func TestRemoteErrors(t *testing.T) {
+	c, done := startServer(t, ventitest.NewMemFS().Handshake)
+	defer done()
+
+	s := sha1.Sum([]byte("missing"))
+	_, err := c.Read(venti.VtData, venti.Score(s[:]), 64)
+	if !errors.Is(err, venti.ErrNotFound) {
+		t.Fatalf("exp %v, got %v", venti.ErrNotFound, err)
+	}
+	var se *venti.ServerError
+	if !errors.As(err, &se) {
+		t.Fatalf("exp a ServerError, got %T", err)
+	}
+	// This is what plan9port's venti says.
+	if exp := fmt.Sprintf("no block with score %x/0 exists", s); se.Msg != exp {
+		t.Fatalf("exp %q, got %q", exp, se.Msg)
+	}
+	if errors.Is(err, venti.ErrTypeMismatch) {
+		t.Fatalf("%v matched %v", err, venti.ErrTypeMismatch)
+	}
+}
+
+func TestRemoteWrappedError(t *testing.T) {
+	// A Handler's own prefix shouldn't hide the error.
+	c, done := startServer(t, ventitest.NewErrFS(fmt.Errorf("store: %w", venti.ErrTooBig)).Handshake)
+	defer done()
+
+	_, err := c.Write(venti.VtData, bytes.NewReader(make([]byte, 100)))
+	if !errors.Is(err, venti.ErrTooBig) {
+		t.Fatalf("exp %v, got %v", venti.ErrTooBig, err)
+	}
+	t.Log(err)
+}
+
+// HangFS never answers a read.
+type hangFS struct {
+	*ventitest.MemFS
+	reading chan struct{}
+}
+
+func (h hangFS) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, h, nil
+}
+
+func (h hangFS) Read(_ venti.Score, _ venti.Type, _ int64) (io.Reader, error) {
+	close(h.reading)
+	select {}
+}
+
+// Calls waiting on a connection that breaks have to fail, not hang.
+func TestClientBroken(t *testing.T) {
+	cc, sc := net.Pipe()
+	h := hangFS{ventitest.NewMemFS(), make(chan struct{})}
+	go (&venti.Server{Handshake: h.Handshake}).ServeConn(sc)
+	c, err := venti.NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	errc := make(chan error)
+	go func() {
+		_, err := c.Read(venti.VtData, make(venti.Score, 20), 10)
+		errc <- err
+	}()
+	<-h.reading
+	sc.Close()
+	if err := <-errc; err == nil {
+		t.Fatal("read on a broken connection succeeded")
+	}
+	if c.Err() == nil {
+		t.Fatal("exp an error from Err, got nil")
+	}
+	if err := c.Ping(); err == nil {
+		t.Fatal("ping on a broken connection succeeded")
+	}
+}
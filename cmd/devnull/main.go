@@ -15,7 +15,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"net"
 	"os"
 
 	"github.com/hdonnay/venti"
@@ -29,7 +28,7 @@ var (
 func main() {
 	flag.Parse()
 
-	l, err := net.Listen("tcp", *addr)
+	l, err := venti.Listen(*addr)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
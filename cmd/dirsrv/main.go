@@ -0,0 +1,63 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Dirsrv serves blocks out of a directory tree.
+
+See the dirfs package for the layout. The -r flag refuses every write, for
+serving a replica; the -w flag refuses writes that would change a stored
+block, and logs them. See the guard package.
+
+The -auth flag names a file of rules for what each client may do; see the
+authz package for the format.
+
+With -cert and -key, connections are served over TLS.
+*/
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/authz"
+	"github.com/hdonnay/venti/dirfs"
+	"github.com/hdonnay/venti/guard"
+)
+
+var (
+	addr = flag.String("a", ":17034", "listen address")
+	root = flag.String("d", "venti", "root directory")
+	ro   = flag.Bool("r", false, "read-only")
+	wo   = flag.Bool("w", false, "write-once: refuse to overwrite blocks")
+	auth = flag.String("auth", "", "authorization rules `file`")
+	cert = flag.String("cert", "", "TLS certificate `file`")
+	key  = flag.String("key", "", "TLS key `file`")
+)
+
+func main() {
+	flag.Parse()
+	fs, err := dirfs.New(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hs := fs.Handshake
+	switch {
+	case *ro:
+		hs = guard.NewReadOnly(fs).Handshake
+	case *wo:
+		hs = guard.NewWriteOnce(fs).Handshake
+	}
+	if *auth != "" {
+		p, err := authz.Load(*auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hs = p.Handshake(hs)
+	}
+	if *cert != "" {
+		log.Fatal(venti.ListenAndServeTLS(*addr, *cert, *key, hs))
+	}
+	log.Fatal(venti.ListenAndServe(*addr, hs))
+}
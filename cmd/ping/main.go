@@ -16,13 +16,13 @@ import (
 )
 
 var (
-	addr = flag.String("a", "[::1]:17034", "listen address")
+	addr = flag.String("a", "[::1]:17034", "server address or dial string")
 )
 
 func main() {
 	flag.Parse()
 
-	c, err := venti.Dial(*addr)
+	c, err := venti.DialAddr(*addr)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
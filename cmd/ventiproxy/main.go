@@ -0,0 +1,56 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Ventiproxy forwards venti connections to one or more upstream servers.
+
+	ventiproxy [-a addr] [-n conns] [-c bytes] [-r] upstream...
+
+Writes go to the first upstream; reads try each in order. See the proxy
+package for details.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/cache"
+	"github.com/hdonnay/venti/proxy"
+)
+
+var (
+	addr  = flag.String("a", ":17034", "listen address")
+	conns = flag.Int("n", 4, "connections per upstream server")
+	csize = flag.Int64("c", 0, "size of the read cache in bytes, 0 to disable")
+	ro    = flag.Bool("r", false, "read-only")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] upstream...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	p, err := proxy.Dial(flag.Args(), *conns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer p.Close()
+	p.ReadOnly = *ro
+
+	hs := p.Handshake
+	if *csize > 0 {
+		hs = cache.New(p, *csize).Handshake
+	}
+	log.Fatal(venti.ListenAndServe(*addr, hs))
+}
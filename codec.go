@@ -0,0 +1,33 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import "github.com/hdonnay/venti/internal/pack"
+
+// These are the codecs a client can offer in its Thello, and a server choose
+// in its Rhello. A server that doesn't know about codecs answers CodecNone,
+// as does one that doesn't support any of the offered ones.
+//
+// After the hello, every packet in both directions goes through the chosen
+// codec. Packets are compressed one at a time; small ones, and ones that
+// don't compress, are sent as they are.
+const (
+	CodecNone uint8 = iota
+	CodecFlate
+)
+
+var codecs = map[uint8]func() pack.Filter{
+	CodecFlate: pack.Flate,
+}
+
+// PickCodec returns the first codec in offer that's supported.
+func pickCodec(offer []byte) uint8 {
+	for _, c := range offer {
+		if _, ok := codecs[c]; ok {
+			return c
+		}
+	}
+	return CodecNone
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// CountConn counts the bytes written to a net.Conn.
+type countConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countConn) wrap(nc net.Conn) net.Conn {
+	c.Conn = nc
+	return c
+}
+
+func TestCodecFlate(t *testing.T) {
+	l, hellos := startAuthServer(t, &venti.Server{})
+	defer l.Close()
+	cc := &countConn{}
+	c, err := dial(t, l, cc.wrap, &venti.ClientConfig{Codecs: []uint8{42, venti.CodecFlate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th := <-hellos; !bytes.Equal(th.Codec, []byte{42, venti.CodecFlate}) {
+		t.Fatalf("server saw codecs %v", th.Codec)
+	}
+
+	before := atomic.LoadInt64(&cc.n)
+	blk := bytes.Repeat([]byte("compressible "), 5000)
+	if _, err := c.Write(venti.VtData, bytes.NewReader(blk)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&cc.n) - before; n > int64(len(blk)/10) {
+		t.Errorf("%d byte block took %d bytes on the wire", len(blk), n)
+	}
+	ventitest.TestHandler(t, c.Handler())
+}
+
+func TestCodecRefused(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{NoCompression: true})
+	defer l.Close()
+	cc := &countConn{}
+	c, err := dial(t, l, cc.wrap, &venti.ClientConfig{Codecs: []uint8{venti.CodecFlate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := atomic.LoadInt64(&cc.n)
+	blk := bytes.Repeat([]byte("compressible "), 5000)
+	if _, err := c.Write(venti.VtData, bytes.NewReader(blk)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&cc.n) - before; n < int64(len(blk)) {
+		t.Errorf("%d byte block took only %d bytes on the wire", len(blk), n)
+	}
+	ventitest.TestHandler(t, c.Handler())
+}
@@ -37,13 +37,9 @@ func randomBlock() (int64, io.Reader, hash.Hash) {
 // Start a server on a random port, connect to it with a client, and return the
 // client and a cleanup function.
 func startServer(t *testing.T, h venti.Handshake) (*venti.Client, func()) {
-	l, err := net.Listen("tcp", "localhost:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	go venti.Serve(l, h)
+	l := listen(t, "localhost:0", h, nil)
 	t.Log("serving on", l.Addr())
-	c, err := venti.Dial(l.Addr().String())
+	c, err := dial(t, l, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,3 +49,48 @@ func startServer(t *testing.T, h venti.Handshake) (*venti.Client, func()) {
 		c.Close()
 	}
 }
+
+// Listen serves h on addr, a dial string as for venti.DialAddr, until the
+// test ends. Each connection the server accepts is passed through wrap, if
+// it's not nil.
+func listen(t *testing.T, addr string, h venti.Handshake, wrap func(net.Conn) net.Conn) net.Listener {
+	l, err := venti.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go venti.Serve(wrapListener{l, wrap}, h)
+	return l
+}
+
+// Dial connects to l, passes the connection through wrap, if it's not nil,
+// and starts a session on it with cfg. The client is closed when the test
+// ends.
+func dial(t *testing.T, l net.Listener, wrap func(net.Conn) net.Conn, cfg *venti.ClientConfig) (*venti.Client, error) {
+	nc, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		nc = wrap(nc)
+	}
+	c, err := venti.NewClientConfig(nc, cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, nil
+}
+
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+func (l wrapListener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil || l.wrap == nil {
+		return nc, err
+	}
+	return l.wrap(nc), nil
+}
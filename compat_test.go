@@ -27,6 +27,10 @@ var (
 		"venti":   "$PLAN9/bin/venti/venti",
 		"devnull": "$PLAN9/src/cmd/venti/o.devnull",
 		"read":    "$PLAN9/bin/venti/read",
+
+		"fmtarenas": "$PLAN9/bin/venti/fmtarenas",
+		"fmtisect":  "$PLAN9/bin/venti/fmtisect",
+		"fmtindex":  "$PLAN9/bin/venti/fmtindex",
 	}
 	nport = new(uint32)
 
@@ -0,0 +1,119 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+// +build compat
+
+package venti_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+)
+
+// StartVenti formats a small store in a new directory, serves it with
+// plan9port's venti, and connects to it.
+func startVenti(t *testing.T) *venti.Client {
+	dir, err := ioutil.TempDir(tmp, "venti-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arenas, isect := filepath.Join(dir, "arenas"), filepath.Join(dir, "isect")
+	for _, f := range []struct {
+		name string
+		size int64
+	}{{arenas, 64 << 20}, {isect, 16 << 20}} {
+		if err := ioutil.WriteFile(f.name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(f.name, f.size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := filepath.Join(dir, "venti.conf")
+	err = ioutil.WriteFile(conf, []byte(fmt.Sprintf("index main\nisect %s\narenas %s\n", isect, arenas)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range [][]string{
+		{exes["fmtarenas"], "-Z", "-a", "16777216", "arenas0", arenas},
+		{exes["fmtisect"], "-Z", "isect0", isect},
+		{exes["fmtindex"], conf},
+	} {
+		if out, err := exec.Command(a[0], a[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %v\n%s", a, err, out)
+		}
+	}
+
+	addr := "unix!" + filepath.Join(dir, "sock")
+	v := exec.Command(exes["venti"], "-c", conf, "-a", addr)
+	t.Log(v.Args)
+	if err := v.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		v.Process.Signal(os.Interrupt)
+		v.Wait()
+	})
+
+	// Starting up reads the whole index, so give it a while.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		c, err := venti.DialAddr(addr)
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("venti never started: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Plan9port's venti has no Has. The client asks with a read of count 0, and
+// venti refuses it as too small when the block is there.
+func TestVentiHas(t *testing.T) {
+	c := startVenti(t)
+	ctx := context.Background()
+
+	b := []byte("has")
+	s, err := c.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		s   venti.Score
+		k   venti.Type
+		exp bool
+	}{
+		{s, venti.VtData, true},
+		{s, venti.VtDir, false},
+		{make(venti.Score, 20), venti.VtData, false},
+	} {
+		ok, err := c.Has(ctx, tc.s, tc.k)
+		if err != nil {
+			t.Fatalf("%v as type %d: %v", tc.s, tc.k, err)
+		}
+		if ok != tc.exp {
+			t.Errorf("%v as type %d: exp %v, got %v", tc.s, tc.k, tc.exp, ok)
+		}
+	}
+
+	// The same refusal, for a read, is ErrTooBig.
+	_, err = c.Read(venti.VtData, s, int64(len(b)-1))
+	if !errors.Is(err, venti.ErrTooBig) {
+		t.Fatalf("exp %v, got %v", venti.ErrTooBig, err)
+	}
+	t.Log(err)
+}
@@ -6,8 +6,10 @@ package venti
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"sync"
@@ -51,17 +53,17 @@ type conn struct {
 	r *pack.Dechunker
 	w *pack.Chunker
 
-	// This is the user-supplied function and the Handler derived from it.
-	hs Handshake
-	h  Handler
+	// This is the Server's settings and the Handler derived from them.
+	srv *Server
+	h   Handler
 }
 
-func accept(nc net.Conn, h Handshake) {
+func accept(nc net.Conn, srv *Server) {
 	c := &conn{
 		Conn: nc,
 		r:    pack.Dechunk(nc),
 		w:    pack.Chunk(nc),
-		hs:   h,
+		srv:  srv,
 	}
 	defer c.Close()
 
@@ -119,12 +121,34 @@ func (c *conn) handshake(cv string) (Handler, error) {
 		return nil, err
 	}
 
-	r, h, err := c.hs(&Thello{
+	hello := &Thello{
 		UID:      th.UID,
 		Strength: th.Strong,
 		Crypto:   th.Crypto,
 		Codec:    th.Codec,
-	})
+		Addr:     c.RemoteAddr(),
+	}
+	tlsIdentity(c.Conn, hello)
+	// An auth exchange the client asked for wins over its certificate.
+	var key []byte
+	if th.Strong&StrengthAuth != 0 {
+		if hello.AuthMethod, key, err = c.auth(th.UID, helloOffers(th.Strong, th.Crypto, th.Codec)); err != nil {
+			return nil, err
+		}
+		hello.UID = th.UID
+	}
+	// Only a session key from the auth exchange can key the crypto.
+	crypto := CryptoNone
+	if key != nil {
+		crypto = pickCrypto(th.Crypto)
+	}
+	if c.srv.RequireCrypto && crypto == CryptoNone {
+		err := fmt.Errorf("%w: session must be encrypted", ErrPermission)
+		c.Err(th.Tag, err)
+		return nil, err
+	}
+
+	r, h, err := c.srv.Handshake(hello)
 	if err != nil {
 		c.Err(th.Tag, err)
 		return nil, err
@@ -139,19 +163,108 @@ func (c *conn) handshake(cv string) (Handler, error) {
 	rh := &msg.Rhello{
 		Tag:    th.Tag,
 		SID:    r.SID,
-		Crypto: r.Crypto,
-		Codec:  r.Codec,
+		Crypto: crypto,
+	}
+	if !c.srv.NoCompression {
+		rh.Codec = pickCodec(th.Codec)
+	}
+	var send, recv pack.Filter
+	if rh.Crypto != CryptoNone {
+		if send, recv, err = cryptoFilters(rh.Crypto, key, false); err != nil {
+			c.Err(th.Tag, err)
+			return nil, err
+		}
 	}
 
-	out := c.w.New()
-	defer out.Close()
-	if _, err := io.Copy(out, rh); err != nil {
-		c.Err(th.Tag, err)
+	if err := c.send(rh); err != nil {
 		return nil, err
 	}
+	// Everything after the Rhello goes through the codec, then the
+	// crypto.
+	if rh.Codec != CodecNone {
+		f := codecs[rh.Codec]()
+		c.w.Push(f)
+		c.r.Push(f)
+	}
+	if rh.Crypto != CryptoNone {
+		c.w.Push(send)
+		c.r.Push(recv)
+	}
 	return h, nil
 }
 
+// Auth runs the server side of the exchange between Thello and Rhello,
+// returning the method used and, if the Authenticator is a
+// KeyedAuthenticator, the session key.
+func (c *conn) auth(uid string, hello []byte) (string, []byte, error) {
+	t0 := &msg.Tauth0{}
+	if err := c.readAuth(msg.KindTauth0, t0); err != nil {
+		return "", nil, err
+	}
+	if c.srv.Auth == nil {
+		err := fmt.Errorf("%w: not supported", ErrAuth)
+		c.Err(t0.Tag, err)
+		return "", nil, err
+	}
+	r0, err := c.srv.Auth.Challenge(uid, t0.Method, t0.Data)
+	if err != nil {
+		c.Err(t0.Tag, err)
+		return "", nil, err
+	}
+	if err := c.send(&msg.Rauth0{Tag: t0.Tag, Data: r0}); err != nil {
+		return "", nil, err
+	}
+
+	t1 := &msg.Tauth1{}
+	if err := c.readAuth(msg.KindTauth1, t1); err != nil {
+		return "", nil, err
+	}
+	r1, err := c.srv.Auth.Verify(uid, t0.Method, hello, t0.Data, r0, t1.Data)
+	if err != nil {
+		c.Err(t1.Tag, err)
+		return "", nil, err
+	}
+	var key []byte
+	if ka, ok := c.srv.Auth.(KeyedAuthenticator); ok {
+		if key, err = ka.SessionKey(uid, t0.Method, t0.Data, r0, t1.Data); err != nil {
+			c.Err(t1.Tag, err)
+			return "", nil, err
+		}
+	}
+	if err := c.send(&msg.Rauth1{Tag: t1.Tag, Data: r1}); err != nil {
+		return "", nil, err
+	}
+	return t0.Method, key, nil
+}
+
+// ReadAuth reads the next packet into m, which must be of the given kind.
+// The data in m is copied out of the packet.
+func (c *conn) readAuth(kind byte, m io.Writer) error {
+	buf, err := c.readPacket()
+	defer doneBuffer(buf)
+	if err != nil {
+		return err
+	}
+	if k := buf.Next(1)[0]; k != kind {
+		err := fmt.Errorf("expected %x, got %x", kind, k)
+		c.Err(buf.Next(1)[0], err)
+		return err
+	}
+	b := append([]byte(nil), buf.Bytes()...)
+	_, err = m.Write(b)
+	return err
+}
+
+// Send writes a whole message to the connection.
+func (c *conn) send(m io.Reader) error {
+	out := c.w.New()
+	if _, err := io.Copy(out, m); err != nil {
+		// Don't send half a message; the frame is left for the collector.
+		return err
+	}
+	return out.Close()
+}
+
 // ReadPacket pulls the next packet off the connection.
 //
 // The returned *bytes.Buffer should be passed to doneBuffer() when done.
@@ -164,6 +277,69 @@ func (c *conn) readPacket() (*bytes.Buffer, error) {
 	return buf, nil
 }
 
+// Write handles a Twrite, passing the block to the Handler as it arrives.
+func (c *conn) write(tag uint8) error {
+	// The type, and padding.
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	b := newBody(c.r)
+	score, err := c.h.Write(Type(hdr[0]), b)
+	if cerr := b.Close(); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		// Errors from the Handler are the client's problem, not the
+		// connection's, so report them and keep going.
+		c.Err(tag, err)
+		return nil
+	}
+	return c.send(&msg.Rwrite{Tag: tag, Score: score})
+}
+
+// Body is the rest of the packet being read, passed on without buffering
+// it. It reads up to the end of the packet and no further, and Close
+// discards whatever's left. Once it's done, the channel from Done is
+// closed.
+type body struct {
+	r    io.Reader
+	err  error // Sticky; io.EOF at the end of the packet.
+	done chan struct{}
+}
+
+func newBody(r io.Reader) *body {
+	return &body{r: r, done: make(chan struct{})}
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.err = err
+		close(b.done)
+	}
+	return n, err
+}
+
+// Close reads the body to its end, returning an error only if the
+// connection failed.
+func (b *body) Close() error {
+	if b.err == nil {
+		io.Copy(ioutil.Discard, b)
+	}
+	if b.err == io.EOF {
+		return nil
+	}
+	return b.err
+}
+
+func (b *body) Done() <-chan struct{} {
+	return b.done
+}
+
 func (c *conn) Close() error {
 	// if we need to do more advance closing behavior, do it here
 	return c.Conn.Close()
@@ -171,7 +347,9 @@ func (c *conn) Close() error {
 
 // Construct an Rerror packet and send it.
 //
-// If passed 'goodbye', end the connection.
+// Errors from the Handler are the client's problem, not the connection's:
+// they're sent back, and the connection carries on. If passed 'goodbye',
+// end the connection.
 func (c *conn) Err(tag uint8, e error) {
 	if e == errGoodbye {
 		c.Close()
@@ -181,15 +359,40 @@ func (c *conn) Err(tag uint8, e error) {
 	defer out.Close()
 	io.Copy(out, &msg.Rerror{
 		Tag: tag,
-		Err: e.Error(),
+		Err: wireError(e),
 	})
 }
 
+// Has answers a Tread with a count of 0, which asks whether a block exists
+// without sending it.
+func (c *conn) has(t *msg.Tread) error {
+	s, k := Score(t.Score), Type(t.Type)
+	ok, err := Has(c.h, s, k)
+	switch {
+	case err != nil:
+		c.Err(t.Tag, err)
+		return nil
+	case !ok:
+		c.Err(t.Tag, NotFound(s, k))
+		return nil
+	}
+	return c.send(&msg.Rread{Tag: t.Tag})
+}
+
 func (c *conn) handle() error {
-	buf, err := c.readPacket()
+	// Writes are streamed to the Handler; everything else is small enough
+	// to read whole.
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] == msg.KindTwrite {
+		return c.write(hdr[1])
+	}
+	buf := newBuffer()
 	defer doneBuffer(buf)
-
-	if err != nil {
+	buf.Write(hdr[:])
+	if _, err := io.Copy(buf, c.r); err != nil {
 		return err
 	}
 
@@ -203,34 +406,24 @@ func (c *conn) handle() error {
 	case msg.KindThello:
 		c.Err(buf.Next(1)[0], errUnexpectedHello)
 		return errUnexpectedHello
-	case msg.KindTwrite:
-		t := &msg.Twrite{}
-		n, err := t.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
-		buf.Next(n)
-		score, err := c.h.Write(Type(t.Type), buf)
-		if err != nil {
-			c.Err(t.Tag, err)
-			return err
-		}
-		r = &msg.Rwrite{
-			Tag:   t.Tag,
-			Score: score,
-		}
 	case msg.KindTread:
 		t := &msg.Tread{}
 		if _, err := t.Write(buf.Bytes()); err != nil {
 			return err
 		}
+		if t.Count == 0 {
+			return c.has(t)
+		}
 		rd, err := c.h.Read(Score(t.Score), Type(t.Type), int64(t.Count))
 		if rc, ok := rd.(io.ReadCloser); ok {
 			defer rc.Close()
 		}
+		if errors.Is(err, ErrNotFound) {
+			err = NotFound(Score(t.Score), Type(t.Type))
+		}
 		if err != nil {
 			c.Err(t.Tag, err)
-			return err
+			return nil
 		}
 		r = &msg.Rread{
 			Tag:  t.Tag,
@@ -240,7 +433,7 @@ func (c *conn) handle() error {
 		tag := buf.Next(1)[0]
 		if err := c.h.Sync(); err != nil {
 			c.Err(tag, err)
-			return err
+			return nil
 		}
 		r = &msg.Rsync{Tag: tag}
 	case msg.KindTgoodbye:
@@ -253,10 +446,5 @@ func (c *conn) handle() error {
 		return err
 	}
 
-	out := c.w.New()
-	// This leaks a buffer if the Copy fails
-	if _, err := io.Copy(out, r); err != nil {
-		return err
-	}
-	return out.Close()
+	return c.send(r)
 }
@@ -0,0 +1,95 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/hdonnay/venti/internal/pack"
+)
+
+// These are the encryption schemes a client can offer in its Thello, and a
+// server choose in its Rhello. A server that doesn't know about encryption
+// answers CryptoNone, as does one that doesn't support any of the offered
+// ones.
+//
+// Encryption is keyed from the auth exchange, so it's only offered and
+// chosen when the client's ClientAuth is a KeyedAuth and the server's
+// Authenticator is a KeyedAuthenticator. The exchange covers the offers,
+// so they can't be stripped on the way. After the hello, every packet in
+// both directions is sealed, after it's compressed.
+//
+// libventi numbers its SSL3 and TLS1 schemes 1 and 2, so ours start well
+// clear of them.
+const (
+	CryptoNone uint8 = 0
+	// CryptoAESGCM is AES-256-GCM, with a key for each direction.
+	CryptoAESGCM uint8 = 16
+)
+
+var cryptos = map[uint8]func(key []byte) (cipher.AEAD, error){
+	CryptoAESGCM: func(key []byte) (cipher.AEAD, error) {
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	},
+}
+
+// A KeyedAuth is a ClientAuth that leaves the client sharing a secret with
+// the server, to key the session's encryption.
+type KeyedAuth interface {
+	ClientAuth
+	// SessionKey returns the shared secret, once Check has passed. It
+	// must be unique to the exchange.
+	SessionKey(uid string, t0, r0, t1 []byte) ([]byte, error)
+}
+
+// A KeyedAuthenticator is the server side of a KeyedAuth.
+type KeyedAuthenticator interface {
+	Authenticator
+	// SessionKey returns the shared secret, once Verify has passed.
+	SessionKey(uid, method string, t0, r0, t1 []byte) ([]byte, error)
+}
+
+// PickCrypto returns the first scheme in offer that's supported.
+func pickCrypto(offer []byte) uint8 {
+	for _, c := range offer {
+		if _, ok := cryptos[c]; ok {
+			return c
+		}
+	}
+	return CryptoNone
+}
+
+// CryptoFilters returns the Filters for the given end of a session using
+// scheme, keyed from the session key.
+func cryptoFilters(scheme uint8, key []byte, client bool) (send, recv pack.Filter, err error) {
+	c, s := directionKey(key, scheme, "client"), directionKey(key, scheme, "server")
+	if !client {
+		c, s = s, c
+	}
+	a, err := cryptos[scheme](c)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := cryptos[scheme](s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pack.AEAD(a), pack.AEAD(b), nil
+}
+
+// DirectionKey derives the key for the packets one end sends.
+func directionKey(key []byte, scheme uint8, end string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte{scheme})
+	m.Write([]byte("venti session " + end))
+	return m.Sum(nil)
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// RecordConn keeps a copy of everything written to a net.Conn.
+type recordConn struct {
+	net.Conn
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.out.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordConn) sent(b []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Contains(c.out.Bytes(), b)
+}
+
+func (c *recordConn) wrap(nc net.Conn) net.Conn {
+	c.Conn = nc
+	return c
+}
+
+func TestCrypto(t *testing.T) {
+	l, hellos := startAuthServer(t, &venti.Server{
+		Auth: venti.Secrets{"glenda": []byte("sesame")},
+	})
+	defer l.Close()
+
+	for _, codecs := range [][]uint8{nil, {venti.CodecFlate}} {
+		rc := &recordConn{}
+		c, err := dial(t, l, rc.wrap, &venti.ClientConfig{
+			UID:    "glenda",
+			Auth:   venti.Secret("sesame"),
+			Codecs: codecs,
+			Crypto: []uint8{42, venti.CryptoAESGCM},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-hellos
+		if c.Crypto != venti.CryptoAESGCM {
+			t.Fatalf("exp crypto %d, got %d", venti.CryptoAESGCM, c.Crypto)
+		}
+
+		secret := bytes.Repeat([]byte("attack at dawn "), 100)
+		s, err := c.Write(venti.VtData, bytes.NewReader(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc.sent([]byte("attack at dawn")) {
+			t.Error("plaintext on the wire")
+		}
+		br, err := c.Read(venti.VtData, s, int64(len(secret)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(br)
+		br.Close()
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Fatalf("read back %d bytes, %v", len(got), err)
+		}
+		ventitest.TestHandler(t, c.Handler())
+		c.Close()
+	}
+}
+
+// Servers that can't key a session leave it in the clear.
+func TestCryptoUnkeyed(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{
+		Auth: unkeyed{venti.Secrets{"glenda": []byte("sesame")}},
+	})
+	defer l.Close()
+
+	c, err := dial(t, l, nil, &venti.ClientConfig{
+		UID:    "glenda",
+		Auth:   venti.Secret("sesame"),
+		Crypto: []uint8{venti.CryptoAESGCM},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Crypto != venti.CryptoNone {
+		t.Fatalf("exp no crypto, got %d", c.Crypto)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Unkeyed hides Secrets' SessionKey.
+type unkeyed struct {
+	a venti.Authenticator
+}
+
+func (u unkeyed) Challenge(uid, method string, t0 []byte) ([]byte, error) {
+	return u.a.Challenge(uid, method, t0)
+}
+
+func (u unkeyed) Verify(uid, method string, hello, t0, r0, t1 []byte) ([]byte, error) {
+	return u.a.Verify(uid, method, hello, t0, r0, t1)
+}
+
+func TestCryptoNeedsKey(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{})
+	defer l.Close()
+
+	if _, err := dial(t, l, nil, &venti.ClientConfig{Crypto: []uint8{venti.CryptoAESGCM}}); err == nil {
+		t.Fatal("offered crypto without a key")
+	}
+}
+
+// TamperConn replaces old with new in everything written to a net.Conn,
+// like someone on the path.
+type tamperConn struct {
+	net.Conn
+	old, new []byte
+}
+
+func (c *tamperConn) wrap(nc net.Conn) net.Conn {
+	c.Conn = nc
+	return c
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(bytes.Replace(b, c.old, c.new, -1)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Swapping the offered scheme for one the server doesn't know would leave
+// the session in the clear, if the auth exchange didn't notice.
+func TestCryptoStripped(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{
+		Auth: venti.Secrets{"glenda": []byte("sesame")},
+	})
+	defer l.Close()
+
+	// The end of the Thello: the uid, the strength, and the crypto offers.
+	tc := &tamperConn{
+		old: []byte("glenda\x01\x01" + string(rune(venti.CryptoAESGCM))),
+		new: []byte("glenda\x01\x01\x2a"),
+	}
+	c, err := dial(t, l, tc.wrap, &venti.ClientConfig{
+		UID:    "glenda",
+		Auth:   venti.Secret("sesame"),
+		Crypto: []uint8{venti.CryptoAESGCM},
+	})
+	if err == nil {
+		c.Close()
+		t.Fatalf("stripped offers went unnoticed; session crypto %d", c.Crypto)
+	}
+	if !errors.Is(err, venti.ErrAuth) {
+		t.Fatalf("exp %v, got %v", venti.ErrAuth, err)
+	}
+}
+
+func TestRequireCrypto(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{
+		Auth:          venti.Secrets{"glenda": []byte("sesame")},
+		RequireCrypto: true,
+	})
+	defer l.Close()
+
+	c, err := dial(t, l, nil, &venti.ClientConfig{
+		UID:    "glenda",
+		Auth:   venti.Secret("sesame"),
+		Crypto: []uint8{venti.CryptoAESGCM},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, cfg := range []*venti.ClientConfig{
+		{UID: "glenda"},
+		{UID: "glenda", Auth: venti.Secret("sesame")},
+		{UID: "glenda", Auth: venti.Secret("sesame"), Crypto: []uint8{42}},
+	} {
+		_, err := dial(t, l, nil, cfg)
+		if !errors.Is(err, venti.ErrPermission) {
+			t.Errorf("%+v: exp %v, got %v", cfg, venti.ErrPermission, err)
+		}
+	}
+}
+
+func TestClientRequireCrypto(t *testing.T) {
+	l, _ := startAuthServer(t, &venti.Server{
+		Auth: unkeyed{venti.Secrets{"glenda": []byte("sesame")}},
+	})
+	defer l.Close()
+
+	cfg := &venti.ClientConfig{
+		UID:           "glenda",
+		Auth:          venti.Secret("sesame"),
+		Crypto:        []uint8{venti.CryptoAESGCM},
+		RequireCrypto: true,
+	}
+	if c, err := dial(t, l, nil, cfg); err == nil {
+		c.Close()
+		t.Fatal("unencrypted session allowed")
+	}
+	cfg.Crypto = nil
+	if c, err := dial(t, l, nil, cfg); err == nil {
+		c.Close()
+		t.Fatal("required crypto without offering any")
+	}
+}
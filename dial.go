@@ -0,0 +1,114 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Port is venti's port, used when an address doesn't name one.
+const Port = "17034"
+
+// DialAddr connects to the venti server at addr, a Plan 9 style dial
+// string:
+//
+//	tcp!host!port
+//	net!host!port
+//	unix!/path/to/socket
+//
+// The port can be left out, or given as "venti", for Port. An address
+// without a '!' is a Go-style TCP address, with or without a port. An
+// empty addr means $venti, as with plan9port's vtdial.
+func DialAddr(addr string) (*Client, error) {
+	return DialContext(context.Background(), nil, addr, nil)
+}
+
+// DialContext is like DialAddr, but dials with d, if it's not nil, and sets
+// up the session with cfg. The context bounds the dial and the hello.
+func DialContext(ctx context.Context, d *net.Dialer, addr string, cfg *ClientConfig) (*Client, error) {
+	if addr == "" {
+		addr = os.Getenv("venti")
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("venti: no address, and $venti is unset")
+	}
+	network, address, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	nc, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	// Cutting the deadline short stops the hello when ctx is done.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	c, err := NewClientConfig(nc, cfg)
+	close(stop)
+	<-stopped
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Listen announces on addr, a dial string as for DialAddr. A host of "*"
+// is every address, as is an empty one; "" listens on Port.
+func Listen(addr string) (net.Listener, error) {
+	network, address, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(network, address)
+}
+
+// SplitAddr turns a dial string into the arguments for net.Dial.
+func splitAddr(addr string) (network, address string, err error) {
+	f := strings.SplitN(addr, "!", 3)
+	if len(f) == 1 {
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			return "tcp", addr, nil
+		}
+		return "tcp", net.JoinHostPort(addr, Port), nil
+	}
+
+	switch network = f[0]; network {
+	case "unix":
+		// Paths can have '!' in them.
+		return network, strings.TrimPrefix(addr, "unix!"), nil
+	case "net":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", fmt.Errorf("venti: unknown network %q in %q", f[0], addr)
+	}
+	host, port := f[1], Port
+	if host == "*" {
+		host = ""
+	}
+	if len(f) == 3 && f[2] != "venti" {
+		port = f[2]
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
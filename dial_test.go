@@ -0,0 +1,99 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func ping(t *testing.T, c *venti.Client, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "venti.sock")
+	listen(t, "unix!"+p, ventitest.NewMemFS().Handshake, nil)
+
+	c, err := venti.DialAddr("unix!" + p)
+	ping(t, c, err)
+}
+
+func TestDialAddr(t *testing.T) {
+	l := listen(t, "tcp!127.0.0.1!0", ventitest.NewMemFS().Handshake, nil)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	for _, addr := range []string{
+		"tcp!127.0.0.1!" + port,
+		"net!localhost!" + port,
+		"127.0.0.1:" + port,
+	} {
+		c, err := venti.DialAddr(addr)
+		ping(t, c, err)
+	}
+
+	defer os.Setenv("venti", os.Getenv("venti"))
+	os.Setenv("venti", "tcp!127.0.0.1!"+port)
+	c, err := venti.DialAddr("")
+	ping(t, c, err)
+}
+
+func TestDialAddrBad(t *testing.T) {
+	defer os.Setenv("venti", os.Getenv("venti"))
+	os.Unsetenv("venti")
+	for _, addr := range []string{"", "udp!localhost!venti", "il!localhost"} {
+		if _, err := venti.DialAddr(addr); err == nil {
+			t.Errorf("%q: wanted an error, didn't get one", addr)
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	l := listen(t, "tcp!127.0.0.1!0", ventitest.NewMemFS().Handshake, nil)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := "tcp!127.0.0.1!" + port
+	d := &net.Dialer{KeepAlive: time.Minute}
+
+	// The deadline is only for setting up.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := venti.DialContext(ctx, d, addr, &venti.ClientConfig{UID: "glenda"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	ping(t, c, nil)
+
+	if c, err := venti.DialContext(ctx, d, addr, nil); err == nil {
+		c.Close()
+		t.Fatal("dialed with a finished context")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	cc, sc := net.Pipe()
+	srv := &venti.Server{Handshake: ventitest.NewMemFS().Handshake}
+	go srv.ServeConn(sc)
+
+	c, err := venti.NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ventitest.TestHandler(t, c.Handler())
+}
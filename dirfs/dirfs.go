@@ -0,0 +1,209 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package dirfs is a venti.Handler that keeps each block as a file in a
+directory tree.
+
+A block with the score "abcd…" and type 3 is stored at "ab/cd/abcd….3" under
+the root. The first byte of each file is the block's type too, and the rest is
+the block itself. Blocks are written to a temporary file and renamed into
+place, so a reader never sees a partial block.
+
+This is meant for small deployments and debugging; there's one file per
+block and no attempt at packing them.
+*/
+package dirfs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hdonnay/venti"
+)
+
+// FS stores blocks under Root.
+type FS struct {
+	Root string
+
+	mu *sync.Mutex
+	// dirty is the set of files and directories that need to be fsync'd on
+	// the next Sync.
+	dirty map[string]struct{}
+}
+
+// New returns an FS rooted at the directory "root", creating it if needed.
+func New(root string) (*FS, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &FS{
+		Root:  root,
+		mu:    &sync.Mutex{},
+		dirty: make(map[string]struct{}),
+	}, nil
+}
+
+// Handshake is a venti.Handshake that serves every client from fs.
+func (fs *FS) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, fs, nil
+}
+
+// Path returns the name of the file the block with score s and type k is
+// kept in.
+func (fs *FS) Path(s venti.Score, k venti.Type) string {
+	h := hex.EncodeToString(s)
+	name := h + "." + strconv.Itoa(int(k))
+	if len(h) < 4 {
+		return filepath.Join(fs.Root, name)
+	}
+	return filepath.Join(fs.Root, h[0:2], h[2:4], name)
+}
+
+// Read opens the block's file. The returned io.Reader is an *os.File, which
+// the server closes once the block has been sent.
+func (fs *FS) Read(s venti.Score, k venti.Type, _ int64) (io.Reader, error) {
+	f, err := os.Open(fs.Path(s, k))
+	if os.IsNotExist(err) {
+		return nil, fs.notFound(s, k)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 1)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("dirfs: %s: bad header: %v", f.Name(), err)
+	}
+	if err := venti.CheckType(s, venti.Type(hdr[0]), k); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// NotFound returns the error for a block that isn't stored: a type mismatch
+// if the score is stored as another type, and venti.NotFound otherwise.
+func (fs *FS) notFound(s venti.Score, k venti.Type) error {
+	p := fs.Path(s, k)
+	ms, _ := filepath.Glob(strings.TrimSuffix(p, filepath.Ext(p)) + ".*")
+	for _, m := range ms {
+		if t, err := strconv.Atoi(filepath.Ext(m)[1:]); err == nil {
+			return venti.CheckType(s, venti.Type(t), k)
+		}
+	}
+	return venti.NotFound(s, k)
+}
+
+// Has reports whether the block's file exists.
+func (fs *FS) Has(s venti.Score, k venti.Type) (bool, error) {
+	_, err := os.Stat(fs.Path(s, k))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Write copies the block into a temporary file, then renames it into place.
+// If the block already exists, the temporary file is discarded.
+func (fs *FS) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	f, err := ioutil.TempFile(fs.Root, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // a no-op once it's been renamed
+
+	h := sha1.New()
+	if _, err := f.Write([]byte{byte(k)}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	s := venti.Score(h.Sum(nil))
+	p := fs.Path(s, k)
+	if ok, err := fs.Has(s, k); err != nil || ok {
+		return s, err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dirty[p] = struct{}{}
+	fs.dirty[dir] = struct{}{}
+	fs.dirty[filepath.Dir(dir)] = struct{}{}
+	fs.dirty[fs.Root] = struct{}{}
+	return s, nil
+}
+
+// Sync fsyncs every file and directory written since the last Sync.
+func (fs *FS) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for p := range fs.dirty {
+		if err := fsync(p); err != nil {
+			return err
+		}
+		delete(fs.dirty, p)
+	}
+	return nil
+}
+
+// Walk calls fn for every block in fs, stopping at the first error.
+func (fs *FS) Walk(fn func(venti.Score, venti.Type, int64) error) error {
+	return filepath.Walk(fs.Root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || fi.Size() < 1 {
+			return nil
+		}
+		name := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+		s, err := hex.DecodeString(name)
+		if err != nil || len(s) == 0 {
+			return nil // not a block, probably a temporary file
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		hdr := make([]byte, 1)
+		_, err = io.ReadFull(f, hdr)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("dirfs: %s: bad header: %v", p, err)
+		}
+		return fn(venti.Score(s), venti.Type(hdr[0]), fi.Size()-1)
+	})
+}
+
+func fsync(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
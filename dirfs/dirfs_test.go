@@ -0,0 +1,103 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package dirfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func newFS(t *testing.T) (*FS, func()) {
+	dir, err := ioutil.TempDir("", "dirfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, func() { os.RemoveAll(dir) }
+}
+
+func TestHandler(t *testing.T) {
+	fs, done := newFS(t)
+	defer done()
+	ventitest.TestHandler(t, fs)
+}
+
+func TestLayout(t *testing.T) {
+	fs, done := newFS(t)
+	defer done()
+
+	s, err := fs.Write(venti.VtDir, strings.NewReader("layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(fs.Root, fs.Path(s, venti.VtDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "20/7b/207b877e"; !strings.HasPrefix(filepath.ToSlash(rel), exp) {
+		t.Fatalf("exp prefix %q, got %q", exp, rel)
+	}
+	if exp := fmt.Sprintf(".%d", venti.VtDir); filepath.Ext(rel) != exp {
+		t.Fatalf("exp suffix %q, got %q", exp, rel)
+	}
+	b, err := ioutil.ReadFile(fs.Path(s, venti.VtDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, got := byte(venti.VtDir), b[0]; exp != got {
+		t.Fatalf("exp type %x, got %x", exp, got)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No temporary files should be left behind.
+	ls, err := ioutil.ReadDir(fs.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range ls {
+		if strings.HasPrefix(fi.Name(), ".tmp-") {
+			t.Errorf("leftover temporary file %q", fi.Name())
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	fs, done := newFS(t)
+	defer done()
+
+	exp := map[string]venti.Type{}
+	for i, k := range []venti.Type{venti.VtData, venti.VtDir, venti.VtRoot} {
+		s, err := fs.Write(k, strings.NewReader(strings.Repeat("x", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp[string(s)] = k
+	}
+	err := fs.Walk(func(s venti.Score, k venti.Type, sz int64) error {
+		if ek, ok := exp[string(s)]; !ok || ek != k {
+			t.Errorf("unexpected block %v type %x", s, k)
+		}
+		delete(exp, string(s))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exp) != 0 {
+		t.Fatalf("%d blocks not walked", len(exp))
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// These are the errors with a meaning on the wire. Handlers should return
+// them, or errors wrapping them, so a server can send a reply the client
+// understands; the Client returns errors that match them with errors.Is.
+var (
+	// ErrNotFound means there's no block with the requested score and type.
+	ErrNotFound = fmt.Errorf("no such block")
+	// ErrTypeMismatch means a block was read with a different type than it
+	// was written with.
+	//
+	// A block is identified by its score and type, so this is a kind of
+	// ErrNotFound, but it usually means a pointer is corrupt. Handlers can
+	// use CheckType to return it.
+	ErrTypeMismatch = fmt.Errorf("block type mismatch")
+	// ErrTooBig means a block is too big to store, or bigger than the count
+	// it was read with.
+	ErrTooBig = fmt.Errorf("block too big")
+	// ErrReadOnly means the server isn't accepting writes.
+	ErrReadOnly = fmt.Errorf("read only")
+	// ErrPermission means the client isn't allowed to do what it asked.
+	ErrPermission = fmt.Errorf("permission denied")
+	// ErrAuth means authentication failed.
+	ErrAuth = fmt.Errorf("authentication failed")
+)
+
+// WireErrors maps each error to the start of the Rerror strings sent for it.
+// Where plan9port's venti has an equivalent, its string is used. An error
+// listed more than once is sent with its first string, and matched by any.
+var wireErrors = []struct {
+	err  error
+	wire string
+}{
+	{ErrNotFound, "no block with score"},
+	{ErrTypeMismatch, "block type mismatch"},
+	{ErrTooBig, "lump too large"},
+	// Plan9port's venti, for a read whose count is smaller than the block.
+	{ErrTooBig, "read too small"},
+	{ErrReadOnly, "read only"},
+	{ErrPermission, "permission denied"},
+	{ErrAuth, "authentication failed"},
+}
+
+// CheckType returns an error wrapping ErrTypeMismatch if the block with the
+// score s was stored as type have and requested as type want.
+func CheckType(s Score, have, want Type) error {
+	if have == want {
+		return nil
+	}
+	return fmt.Errorf("%w: %v has type %d, not %d", ErrTypeMismatch, s, have, want)
+}
+
+// NotFound returns an error wrapping ErrNotFound for the block (s, t), worded
+// the way plan9port's venti does.
+func NotFound(s Score, t Type) error {
+	return &notFound{s, t}
+}
+
+type notFound struct {
+	s Score
+	t Type
+}
+
+func (e *notFound) Error() string {
+	return fmt.Sprintf("no block with score %x/%d exists", []byte(e.s), e.t)
+}
+
+func (e *notFound) Unwrap() error { return ErrNotFound }
+
+// A ServerError is an error the server sent in an Rerror. Anything else the
+// Client returns is a local or connection error.
+//
+// A ServerError matches the errors above with errors.Is, if the server sent
+// the matching string.
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string { return e.Msg }
+
+// Is reports whether the server's message is the one sent for target.
+func (e *ServerError) Is(target error) bool {
+	for _, w := range wireErrors {
+		if target == w.err && strings.HasPrefix(e.Msg, w.wire) {
+			return true
+		}
+	}
+	return false
+}
+
+// WireError returns the string to send in an Rerror for e.
+//
+// Handlers wrapping other Handlers put their own prefixes on errors, so the
+// string for a known error is moved to the front where the other end can
+// find it.
+func wireError(e error) string {
+	s := e.Error()
+	for _, w := range wireErrors {
+		if !errors.Is(e, w.err) {
+			continue
+		}
+		if !strings.HasPrefix(s, w.wire) {
+			s = w.wire + ": " + s
+		}
+		return s
+	}
+	return s
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package guard has venti.Handlers that restrict what clients can do to the
+Handler they wrap, for exposing a store to clients that aren't trusted with
+it.
+
+A ReadOnly refuses every write. A WriteOnce accepts new blocks, but refuses
+to store a score that's already there with a different type or different
+data, and logs the attempt. Writing a block that's already stored is fine,
+and doesn't touch the store.
+*/
+package guard
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/hdonnay/venti"
+)
+
+// ErrOverwrite is returned by a WriteOnce for a write that would replace a
+// stored block.
+var ErrOverwrite = fmt.Errorf("refusing to overwrite block")
+
+// ReadOnly wraps a venti.Handler, failing every write with
+// venti.ErrReadOnly.
+type ReadOnly struct {
+	h venti.Handler
+}
+
+// NewReadOnly returns a ReadOnly in front of h.
+func NewReadOnly(h venti.Handler) *ReadOnly {
+	return &ReadOnly{h: h}
+}
+
+// Handshake is a venti.Handshake that serves every client from r.
+func (r *ReadOnly) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, r, nil
+}
+
+func (r *ReadOnly) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	return r.h.Read(s, k, ct)
+}
+
+func (r *ReadOnly) Has(s venti.Score, k venti.Type) (bool, error) {
+	return venti.Has(r.h, s, k)
+}
+
+func (r *ReadOnly) Write(_ venti.Type, _ io.Reader) (venti.Score, error) {
+	return nil, venti.ErrReadOnly
+}
+
+func (r *ReadOnly) Sync() error {
+	return r.h.Sync()
+}
+
+// WriteOnce wraps a venti.Handler, refusing writes that would change a block
+// that's already stored.
+type WriteOnce struct {
+	h venti.Handler
+
+	// Log is where refused writes are reported. If nil, the log package's
+	// standard logger is used.
+	Log *log.Logger
+
+	// Checking and writing a block has to happen under a lock, or two
+	// writes of the same score could both pass the check. The lock is
+	// picked by the score's first byte.
+	mu [256]sync.Mutex
+}
+
+// NewWriteOnce returns a WriteOnce in front of h.
+func NewWriteOnce(h venti.Handler) *WriteOnce {
+	return &WriteOnce{h: h}
+}
+
+// Handshake is a venti.Handshake that serves every client from w.
+func (w *WriteOnce) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, w, nil
+}
+
+func (w *WriteOnce) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	return w.h.Read(s, k, ct)
+}
+
+func (w *WriteOnce) Has(s venti.Score, k venti.Type) (bool, error) {
+	return venti.Has(w.h, s, k)
+}
+
+// Write looks for the block before writing it. The score isn't known until
+// the block has been read, so the block is buffered first.
+func (w *WriteOnce) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	buf := &bytes.Buffer{}
+	h := sha1.New()
+	if _, err := io.Copy(buf, io.TeeReader(r, h)); err != nil {
+		return nil, err
+	}
+	s := venti.Score(h.Sum(nil))
+
+	mu := &w.mu[s[0]]
+	mu.Lock()
+	defer mu.Unlock()
+
+	old, err := w.h.Read(s, k, int64(buf.Len()))
+	if rc, ok := old.(io.Closer); ok {
+		defer rc.Close()
+	}
+	switch {
+	case errors.Is(err, venti.ErrNotFound):
+		got, err := w.h.Write(k, buf)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(got, s) {
+			return nil, fmt.Errorf("guard: returned score %v for %v", got, s)
+		}
+		return s, nil
+	case errors.Is(err, venti.ErrTypeMismatch):
+		return nil, w.refuse(fmt.Errorf("refusing to store %v as type %d: %w", s, k, err))
+	case err != nil:
+		return nil, err
+	}
+	d, err := ioutil.ReadAll(old)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(d, buf.Bytes()) {
+		// Same score, different data: a hash collision, or a store that's
+		// lying.
+		return nil, w.refuse(fmt.Errorf("%w %v as type %d: stored data differs", ErrOverwrite, s, k))
+	}
+	return s, nil
+}
+
+// Refuse logs a refused write and returns err.
+func (w *WriteOnce) refuse(err error) error {
+	if w.Log != nil {
+		w.Log.Print("guard: ", err)
+	} else {
+		log.Print("guard: ", err)
+	}
+	return err
+}
+
+func (w *WriteOnce) Sync() error {
+	return w.h.Sync()
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package guard
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func TestReadOnly(t *testing.T) {
+	fs := ventitest.NewMemFS()
+	s, err := fs.Write(venti.VtData, strings.NewReader("archived"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go venti.Serve(l, NewReadOnly(fs).Handshake)
+	c, err := venti.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Clients should be able to tell why the write failed.
+	if _, err := c.Write(venti.VtData, strings.NewReader("new")); !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+	r, err := c.Read(venti.VtData, s, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, _ := ioutil.ReadAll(r); string(got) != "archived" {
+		t.Fatalf("exp %q, got %q", "archived", got)
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	ventitest.TestHandler(t, NewWriteOnce(ventitest.NewMemFS()))
+}
+
+// The same score can't be stored again as another type.
+func TestOverwriteType(t *testing.T) {
+	w := NewWriteOnce(ventitest.NewMemFS())
+	logs := &bytes.Buffer{}
+	w.Log = log.New(logs, "", 0)
+
+	s, err := w.Write(venti.VtDir, strings.NewReader("entries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(venti.VtData, strings.NewReader("entries")); !errors.Is(err, venti.ErrTypeMismatch) {
+		t.Fatalf("exp %v, got %v", venti.ErrTypeMismatch, err)
+	}
+	if !strings.Contains(logs.String(), s.String()) {
+		t.Fatalf("refused write wasn't logged: %q", logs.String())
+	}
+	if _, err := w.Read(s, venti.VtDir, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Read(s, venti.VtData, 7); !errors.Is(err, venti.ErrTypeMismatch) {
+		t.Fatalf("exp %v, got %v", venti.ErrTypeMismatch, err)
+	}
+}
+
+// Corrupt flips a bit in everything read out of it.
+type corrupt struct {
+	venti.Handler
+}
+
+func (c corrupt) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	r, err := c.Handler.Read(s, k, ct)
+	if err != nil {
+		return nil, err
+	}
+	d, _ := ioutil.ReadAll(r)
+	if len(d) != 0 {
+		d[0] ^= 1
+	}
+	return bytes.NewReader(d), nil
+}
+
+func TestOverwriteData(t *testing.T) {
+	w := NewWriteOnce(corrupt{ventitest.NewMemFS()})
+	w.Log = log.New(ioutil.Discard, "", 0)
+
+	if _, err := w.Write(venti.VtData, strings.NewReader("block")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(venti.VtData, strings.NewReader("block")); !errors.Is(err, ErrOverwrite) {
+		t.Fatalf("exp %v, got %v", ErrOverwrite, err)
+	}
+}
@@ -4,11 +4,17 @@
 
 package venti
 
-import "io"
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+)
 
 // Thello is the client's hello message.
 //
-// All current implementations ignore all these fields.
+// The server acts on StrengthAuth in Strength; everything else is left to
+// the Handshake.
 type Thello struct {
 	// UID is the identity of the connecting user.
 	UID string
@@ -16,9 +22,18 @@ type Thello struct {
 	// compression.
 	Strength uint8
 
-	// Crypto and Codec are arguments to the negotiation indicated by Strength
+	// Crypto and Codec are the encryption schemes and codecs the client
+	// offers, most preferred first.
 	Crypto []byte
 	Codec  []byte
+
+	// Addr is the client's address, and AuthMethod the method that
+	// verified UID, or empty if it's only what the client claims. TLS is
+	// the state of the connection, if it's over TLS. None of them are part
+	// of the message; the server fills them in.
+	Addr       net.Addr
+	AuthMethod string
+	TLS        *tls.ConnectionState
 }
 
 // Rhello is the server's response to a Thello.
@@ -29,7 +44,7 @@ type Rhello struct {
 	SID string
 
 	// Crypto and Codec are the response to the crypto and compression
-	// negotiation.
+	// negotiation. The server picks both itself; these are ignored.
 	Crypto uint8
 	Codec  uint8
 }
@@ -64,3 +79,39 @@ type Handler interface {
 	// persisted. It should delay returning until this is done.
 	Sync() error
 }
+
+// Haser is an optional interface for Handlers that can tell whether they
+// have a block without reading it.
+//
+// A Tread with a count of 0 asks only whether the block exists: the reply
+// is an empty Rread if it does, and an error if it doesn't. The server
+// answers it with Has; Read is never called with a count of 0. See
+// Client.Has.
+//
+// Stores should implement it. Handlers that wrap others should too, asking
+// the ones they wrap with the Has function.
+type Haser interface {
+	// Has reports whether the block identified by the score, type pair
+	// is stored. A block stored with another type isn't.
+	Has(score Score, kind Type) (bool, error)
+}
+
+// Has reports whether h has the block (s, t). If h isn't a Haser, the
+// block is read, with the largest count a Tread can ask for, and thrown
+// away.
+func Has(h Handler, s Score, t Type) (bool, error) {
+	if hs, ok := h.(Haser); ok {
+		return hs.Has(s, t)
+	}
+	rd, err := h.Read(s, t, 1<<32-1)
+	if rc, ok := rd.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrTypeMismatch):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// CountFS counts the bytes read out of its blocks. It's a Haser if has is
+// set.
+type countFS struct {
+	fs  *ventitest.MemFS
+	has bool
+	n   int64
+}
+
+func (c *countFS) Handshake(*venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	if c.has {
+		return nil, haserFS{c}, nil
+	}
+	return nil, c, nil
+}
+
+func (c *countFS) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	r, err := c.fs.Read(s, k, ct)
+	if err != nil {
+		return nil, err
+	}
+	return countReader{r, &c.n}, nil
+}
+
+func (c *countFS) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	return c.fs.Write(k, r)
+}
+
+func (c *countFS) Sync() error { return c.fs.Sync() }
+
+type haserFS struct {
+	*countFS
+}
+
+func (h haserFS) Has(s venti.Score, k venti.Type) (bool, error) {
+	return h.fs.Has(s, k)
+}
+
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func testHas(t *testing.T, has bool) {
+	fs := &countFS{fs: ventitest.NewMemFS(), has: has}
+	c, done := startServer(t, fs.Handshake)
+	defer done()
+
+	s, err := c.Write(venti.VtData, bytes.NewReader(make([]byte, 50000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		s   venti.Score
+		t   venti.Type
+		exp bool
+	}{
+		{s, venti.VtData, true},
+		{s, venti.VtDir, false},
+		{make(venti.Score, 20), venti.VtData, false},
+	} {
+		ok, err := c.Has(ctx, tc.s, tc.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.exp {
+			t.Errorf("Has(%v, %d): exp %v, got %v", tc.s, tc.t, tc.exp, ok)
+		}
+	}
+	if n := atomic.LoadInt64(&fs.n); n != 0 {
+		t.Errorf("read %d bytes of the block", n)
+	}
+	// An ordinary read still gets the block.
+	rc, err := c.Read(venti.VtData, s, 50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if n, err := io.Copy(ioutil.Discard, rc); err != nil || n != 50000 {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+}
+
+// A Haser answers Has without reading the block.
+func TestHas(t *testing.T) { testHas(t, true) }
+
+// Other Handlers answer it without sending the block.
+func TestHasRead(t *testing.T) { testHas(t, false) }
+
+// Errors other than a missing block are reported.
+func TestHasError(t *testing.T) {
+	c, done := startServer(t, ventitest.NewErrFS(venti.ErrPermission).Handshake)
+	defer done()
+
+	ok, err := c.Has(context.Background(), make(venti.Score, 20), venti.VtData)
+	if ok || !errors.Is(err, venti.ErrPermission) {
+		t.Fatalf("exp ErrPermission, got %v, %v", ok, err)
+	}
+}
+
+// Plan9port's venti answers a count smaller than the block with its own
+// string, which still means the block is there. TestVentiHas checks the
+// real thing.
+func TestHasTooSmall(t *testing.T) {
+	err := errors.New("read too small: asked for 0 need at least 3")
+	c, done := startServer(t, ventitest.NewErrFS(err).Handshake)
+	defer done()
+
+	ok, err := c.Has(context.Background(), make(venti.Score, 20), venti.VtData)
+	if !ok || err != nil {
+		t.Fatalf("exp true, got %v, %v", ok, err)
+	}
+}
+
+// A count of 0 is a Has on the wire, but a Read with it still reads: only
+// the empty block fits.
+func TestReadCountZero(t *testing.T) {
+	c, done := startServer(t, ventitest.NewMemFS().Handshake)
+	defer done()
+
+	s, err := c.Write(venti.VtData, bytes.NewReader([]byte("not empty")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := c.Write(venti.VtData, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Read(venti.VtData, s, 0); !errors.Is(err, venti.ErrTooBig) {
+		t.Errorf("exp %v, got %v", venti.ErrTooBig, err)
+	}
+	if _, err := c.Read(venti.VtData, make(venti.Score, 20), 0); !errors.Is(err, venti.ErrNotFound) {
+		t.Errorf("exp %v, got %v", venti.ErrNotFound, err)
+	}
+	rc, err := c.Read(venti.VtData, empty, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || len(b) != 0 {
+		t.Fatalf("read %d bytes: %v", len(b), err)
+	}
+
+	_, err = c.ReadBatch(context.Background(), []venti.ReadRequest{
+		{Type: venti.VtData, Score: empty},
+		{Type: venti.VtData, Score: s},
+	})
+	var be *venti.BatchError
+	if !errors.As(err, &be) || be.Index != 1 || !errors.Is(err, venti.ErrTooBig) {
+		t.Fatalf("exp %v for the second block, got %v", venti.ErrTooBig, err)
+	}
+}
+
+// A server forwarding to another with a Client asks it Has too, rather
+// than reading the block.
+func TestHasForwarded(t *testing.T) {
+	fs := &countFS{fs: ventitest.NewMemFS(), has: true}
+	up, done := startServer(t, fs.Handshake)
+	defer done()
+	c, done := startServer(t, func(*venti.Thello) (*venti.Rhello, venti.Handler, error) {
+		return nil, up.Handler(), nil
+	})
+	defer done()
+
+	s, err := c.Write(venti.VtData, bytes.NewReader(make([]byte, 50000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []venti.Type{venti.VtData, venti.VtDir} {
+		ok, err := c.Has(context.Background(), s, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (k == venti.VtData) {
+			t.Errorf("Has(%v, %d): got %v", s, k, ok)
+		}
+	}
+	if n := atomic.LoadInt64(&fs.n); n != 0 {
+		t.Errorf("read %d bytes of the block", n)
+	}
+}
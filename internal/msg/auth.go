@@ -0,0 +1,147 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hdonnay/venti/internal/pack"
+)
+
+// The auth messages have no description in venti(7); libventi reserves the
+// numbers and nothing more. Here they're a two-round exchange between the
+// Thello and the Rhello, when the Thello's Strong field asks for it:
+//
+//	Tauth0 tag[1] method[s] data[v]
+//	Rauth0 tag[1] data[v]
+//	Tauth1 tag[1] data[v]
+//	Rauth1 tag[1] data[v]
+//
+// What the data means is up to the method.
+
+// Tauth0 starts authentication with the named method.
+type Tauth0 struct {
+	Tag    byte
+	Method string
+	Data   []byte
+}
+
+func (m *Tauth0) Read(b []byte) (int, error) {
+	sz := 5 + len(m.Method) + len(m.Data)
+	if cap(b) < sz {
+		return 0, io.ErrShortBuffer
+	}
+	b = b[:sz]
+	b[0] = KindTauth0
+	b[1] = m.Tag
+	off := 2
+	off += pack.String(b[off:], m.Method)
+	off += pack.Var(b[off:], m.Data)
+	return off, io.EOF
+}
+
+func (m *Tauth0) Write(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, ErrBufTooSmall
+	}
+	m.Tag = b[0]
+	off, acc := 1, 0
+	if _, n := pack.UnUint16(b[off:]); len(b) < off+2+int(n) {
+		return 0, ErrBufTooSmall
+	}
+	acc, m.Method = pack.UnString(b[off:])
+	off += acc
+	if len(b) < off+1 {
+		return 0, ErrBufTooSmall
+	}
+	acc, m.Data = pack.UnVar(b[off:])
+	return off + acc, nil
+}
+
+func (m *Tauth0) String() string {
+	return fmt.Sprintf("Tauth0 tag(%x) method(%s) data(%x)", m.Tag, m.Method, m.Data)
+}
+
+// Rauth0 is the server's answer to a Tauth0.
+type Rauth0 struct {
+	Tag  byte
+	Data []byte
+}
+
+func (m *Rauth0) Read(b []byte) (int, error) {
+	return readAuth(b, KindRauth0, m.Tag, m.Data)
+}
+
+func (m *Rauth0) Write(b []byte) (int, error) {
+	return writeAuth(b, &m.Tag, &m.Data)
+}
+
+func (m *Rauth0) String() string {
+	return fmt.Sprintf("Rauth0 tag(%x) data(%x)", m.Tag, m.Data)
+}
+
+// Tauth1 is the client's second message.
+type Tauth1 struct {
+	Tag  byte
+	Data []byte
+}
+
+func (m *Tauth1) Read(b []byte) (int, error) {
+	return readAuth(b, KindTauth1, m.Tag, m.Data)
+}
+
+func (m *Tauth1) Write(b []byte) (int, error) {
+	return writeAuth(b, &m.Tag, &m.Data)
+}
+
+func (m *Tauth1) String() string {
+	return fmt.Sprintf("Tauth1 tag(%x) data(%x)", m.Tag, m.Data)
+}
+
+// Rauth1 finishes authentication.
+type Rauth1 struct {
+	Tag  byte
+	Data []byte
+}
+
+func (m *Rauth1) Read(b []byte) (int, error) {
+	return readAuth(b, KindRauth1, m.Tag, m.Data)
+}
+
+func (m *Rauth1) Write(b []byte) (int, error) {
+	return writeAuth(b, &m.Tag, &m.Data)
+}
+
+func (m *Rauth1) String() string {
+	return fmt.Sprintf("Rauth1 tag(%x) data(%x)", m.Tag, m.Data)
+}
+
+// The last three auth messages are the same but for their kind.
+
+func readAuth(b []byte, kind, tag byte, data []byte) (int, error) {
+	sz := 3 + len(data)
+	if cap(b) < sz {
+		return 0, io.ErrShortBuffer
+	}
+	b = b[:sz]
+	b[0] = kind
+	b[1] = tag
+	pack.Var(b[2:], data)
+	return sz, io.EOF
+}
+
+func writeAuth(b []byte, tag *byte, data *[]byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ErrBufTooSmall
+	}
+	*tag = b[0]
+	if len(b) < 2+int(b[1]) {
+		return 0, ErrBufTooSmall
+	}
+	n, d := pack.UnVar(b[1:])
+	*data = d
+	return n + 1, nil
+}
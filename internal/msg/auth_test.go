@@ -0,0 +1,84 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var (
+	authRead = []RRow{
+		{
+			R: &Tauth0{},
+			B: []byte{0x08, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			R: &Tauth0{Tag: 1, Method: "secret", Data: []byte{0xAA, 0xBB}},
+			B: []byte{
+				0x08, 0x01, 0x00, 0x06, 0x73, 0x65, 0x63, 0x72, 0x65, 0x74, 0x02,
+				0xAA, 0xBB,
+			},
+		},
+		{
+			R: &Rauth0{Tag: 2, Data: []byte{0x01}},
+			B: []byte{0x09, 0x02, 0x01, 0x01},
+		},
+		{
+			R: &Tauth1{Tag: 3},
+			B: []byte{0x0a, 0x03, 0x00},
+		},
+		{
+			R: &Rauth1{Tag: 4, Data: []byte{0xFF, 0xFE}},
+			B: []byte{0x0b, 0x04, 0x02, 0xFF, 0xFE},
+		},
+	}
+
+	authWrite = []WRow{
+		{A: &Tauth0{}, B: &Tauth0{}},
+		{A: &Rauth0{}, B: &Rauth0{}},
+		{A: &Tauth1{}, B: &Tauth1{}},
+		{A: &Rauth1{}, B: &Rauth1{}},
+	}
+)
+
+func TestAuthPack(t *testing.T) {
+	readerTest(t, authRead)
+}
+
+func TestAuthUnpack(t *testing.T) {
+	writerTest(t, authWrite)
+}
+
+// The table tests above only compare field names, so check the values
+// survive a round trip.
+func TestAuthRoundTrip(t *testing.T) {
+	tt := []struct {
+		in, out io.ReadWriter
+	}{
+		{&Tauth0{Tag: 7, Method: "secret", Data: []byte("nonce")}, &Tauth0{}},
+		{&Rauth0{Tag: 8, Data: []byte("challenge")}, &Rauth0{}},
+		{&Tauth1{Tag: 9, Data: []byte("response")}, &Tauth1{}},
+		{&Rauth1{Tag: 10, Data: []byte("proof")}, &Rauth1{}},
+	}
+	for _, tc := range tt {
+		buf := &bytes.Buffer{}
+		if _, err := io.Copy(buf, tc.in); err != nil {
+			t.Fatal(err)
+		}
+		buf.Next(1)
+		if _, err := tc.out.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.in, tc.out) {
+			t.Fatalf("exp %v, got %v", tc.in, tc.out)
+		}
+	}
+	if _, err := (&Tauth0{}).Write([]byte{0x01, 0x00, 0x09, 'x'}); err == nil {
+		t.Fatal("wanted an error, didn't get one")
+	}
+}
@@ -37,6 +37,15 @@ var (
 	_ io.ReadWriter = (*msg.Rsync)(nil)
 	_ fmt.Stringer  = (*msg.Rsync)(nil)
 
+	_ io.ReadWriter = (*msg.Tauth0)(nil)
+	_ fmt.Stringer  = (*msg.Tauth0)(nil)
+	_ io.ReadWriter = (*msg.Rauth0)(nil)
+	_ fmt.Stringer  = (*msg.Rauth0)(nil)
+	_ io.ReadWriter = (*msg.Tauth1)(nil)
+	_ fmt.Stringer  = (*msg.Tauth1)(nil)
+	_ io.ReadWriter = (*msg.Rauth1)(nil)
+	_ fmt.Stringer  = (*msg.Rauth1)(nil)
+
 	_ io.ReadWriter = (*msg.Tgoodbye)(nil)
 	_ fmt.Stringer  = (*msg.Tgoodbye)(nil)
 
@@ -21,10 +21,10 @@ const (
 	KindRhello
 	KindTgoodbye
 	KindRgoodbye /* not used */
-	KindTauth0   /* auth messages not implemented */
-	KindRauth0   /* auth messages not implemented */
-	KindTauth1   /* auth messages not implemented */
-	KindRauth1   /* auth messages not implemented */
+	KindTauth0
+	KindRauth0
+	KindTauth1
+	KindRauth1
 	KindTread
 	KindRread
 	KindTwrite
@@ -0,0 +1,58 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package pack
+
+import (
+	"crypto/cipher"
+	"fmt"
+)
+
+type aeadFilter struct {
+	a cipher.AEAD
+	// Seal and open count the packets sent and received. The count is the
+	// nonce, so nothing extra goes on the wire, and a packet that's
+	// dropped, replayed, or reordered fails to open.
+	seal, open uint64
+}
+
+// AEAD returns a Filter that seals each packet with a, and opens packets
+// sealed by the same Filter on the other end.
+//
+// Nonces come from a count of packets, so a key must only ever be used for
+// one direction of one connection: push a separate AEAD Filter, with its
+// own key, onto each of the Chunker and Dechunker.
+func AEAD(a cipher.AEAD) Filter {
+	if a.NonceSize() < 8 {
+		panic("pack: AEAD nonce too small")
+	}
+	return &aeadFilter{a: a}
+}
+
+func (f *aeadFilter) nonce(n uint64) []byte {
+	b := make([]byte, f.a.NonceSize())
+	be.PutUint64(b[len(b)-8:], n)
+	return b
+}
+
+func (f *aeadFilter) Encode(dst, src []byte) ([]byte, error) {
+	if f.seal == ^uint64(0) {
+		return nil, fmt.Errorf("pack: AEAD nonces exhausted")
+	}
+	out := f.a.Seal(dst, f.nonce(f.seal), src, nil)
+	f.seal++
+	return out, nil
+}
+
+func (f *aeadFilter) Decode(dst, src []byte) ([]byte, error) {
+	if f.open == ^uint64(0) {
+		return nil, fmt.Errorf("pack: AEAD nonces exhausted")
+	}
+	out, err := f.a.Open(dst, f.nonce(f.open), src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("pack: opening packet %d: %v", f.open, err)
+	}
+	f.open++
+	return out, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package pack
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Packets compressed by the flate Filter start with one of these.
+const (
+	flateRaw byte = iota
+	flateDeflated
+)
+
+// Packets smaller than this aren't worth compressing.
+const flateMin = 64
+
+var flatePool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+type flateFilter struct{}
+
+// Flate returns a Filter that compresses each packet on its own with
+// DEFLATE. Packets that are small, or that don't get smaller, are sent as
+// they are.
+func Flate() Filter {
+	return flateFilter{}
+}
+
+func (flateFilter) Encode(dst, src []byte) ([]byte, error) {
+	if len(src) < flateMin {
+		return append(append(dst, flateRaw), src...), nil
+	}
+	buf := bytes.NewBuffer(append(dst, flateDeflated))
+	w := flatePool.Get().(*flate.Writer)
+	defer flatePool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	if len(out)-len(dst) > len(src) {
+		return append(append(out[:len(dst)], flateRaw), src...), nil
+	}
+	return out, nil
+}
+
+func (flateFilter) Decode(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, fmt.Errorf("pack: empty flate packet")
+	}
+	switch src[0] {
+	case flateRaw:
+		return append(dst, src[1:]...), nil
+	case flateDeflated:
+	default:
+		return nil, fmt.Errorf("pack: bad flate packet header %x", src[0])
+	}
+	r := flate.NewReader(bytes.NewReader(src[1:]))
+	defer r.Close()
+	buf := bytes.NewBuffer(dst)
+	n, err := io.Copy(buf, io.LimitReader(r, maxPacket+1))
+	if err != nil {
+		return nil, fmt.Errorf("pack: inflating packet: %v", err)
+	}
+	if n > maxPacket {
+		return nil, fmt.Errorf("pack: packet inflates past %d bytes", maxPacket)
+	}
+	return buf.Bytes(), nil
+}
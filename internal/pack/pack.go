@@ -10,15 +10,22 @@ package pack
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 )
 
 var be = binary.BigEndian
 
+// MaxPacket bounds the packets that are read whole: filtered packets, as
+// sent and once decoded. The length comes from the peer, so it's checked
+// before anything is allocated for it.
+const maxPacket = 1 << 25
+
 // UnString unpacks a string from the []byte, returning the number of bytes used
 // and the string.
 func UnString(b []byte) (int, string) {
@@ -89,13 +96,36 @@ func UnVar(b []byte) (int, []byte) {
 	return l + 1, b[1 : l+1]
 }
 
-var (
-	pktPool = sync.Pool{
-		New: func() interface{} {
-			return bytes.NewBuffer(make([]byte, 0, 4096))
-		},
-	}
-)
+// HdrSize is the size of the length at the start of every packet.
+const hdrSize = 4
+
+// MaxPooled is the largest frame buffer that goes back in the pool; bigger
+// ones are left for the collector.
+const maxPooled = 1 << 17
+
+// FramePool holds *[]byte, so putting them back doesn't allocate. Each has
+// room for the header reserved at the start.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, hdrSize, 4096)
+		return &b
+	},
+}
+
+// A Filter transforms packet payloads, for compression or encryption.
+//
+// Filters are pushed onto a Chunker and Dechunker once both ends have agreed
+// on them. A Chunker encodes with its Filters in the order they were pushed,
+// and a Dechunker decodes in the reverse order, so the same Filters should
+// be pushed on both ends of a connection in the same order.
+type Filter interface {
+	// Encode appends the encoded form of src to dst and returns the
+	// result. Encode is called for one packet at a time, in the order the
+	// packets are sent.
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode undoes Encode, in the same way.
+	Decode(dst, src []byte) ([]byte, error)
+}
 
 // Chunker yeilds writers that emit venti-format packets.
 //
@@ -103,29 +133,16 @@ var (
 type Chunker struct {
 	mu     *sync.Mutex
 	w      io.Writer
+	filter []Filter
 	Chatty bool
 }
 
-// cw buffers all writes until closed, then determines the length written,
-// secures the lock, and writes the buffered data.
-type cw struct {
-	bytes.Buffer
-	c *Chunker
-}
-
-func (w *cw) Close() error {
-	defer pktPool.Put(&w.Buffer)
-	b := make([]byte, 4)
-
-	be.PutUint32(b, uint32(w.Buffer.Len()))
-	if w.c.Chatty {
-		bb := w.Buffer.Bytes()
-		log.Printf("<- len:%d kind:%x tag:%x\n", w.Buffer.Len(), bb[0], bb[1])
-	}
-	w.c.mu.Lock()
-	defer w.c.mu.Unlock()
-	_, err := io.Copy(w.c.w, io.MultiReader(bytes.NewReader(b), &w.Buffer))
-	return err
+// Push adds f to the Filters packets are encoded with. Packets already
+// closed aren't affected.
+func (w *Chunker) Push(f Filter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.filter = append(w.filter, f)
 }
 
 // Chunk returns a Chunker that writes to 'w'.
@@ -136,14 +153,104 @@ func Chunk(w io.Writer) *Chunker {
 	}
 }
 
-// New returns a io.WriteCloser that buffers writes and frames and flushes data
-// when closed.
+// A frame is a packet being built. Writes are appended after space left for
+// the length, so an unfiltered packet goes out in one write without being
+// copied again.
+type frame struct {
+	c *Chunker
+	b *[]byte // Nil once closed.
+}
+
+// New returns a io.WriteCloser to write a packet into. The packet is sent
+// when it's closed. It's an io.ReaderFrom, so io.Copy into it doesn't need
+// a buffer of its own.
 func (w *Chunker) New() io.WriteCloser {
-	b := pktPool.Get().(*bytes.Buffer)
-	return &cw{
-		Buffer: *b,
-		c:      w,
+	return &frame{
+		c: w,
+		b: framePool.Get().(*[]byte),
+	}
+}
+
+func (f *frame) Write(p []byte) (int, error) {
+	if f.b == nil {
+		return 0, io.ErrClosedPipe
+	}
+	*f.b = append(*f.b, p...)
+	return len(p), nil
+}
+
+// ReadFrom reads r into the frame until io.EOF. The messages in package msg
+// want a buffer big enough for all of them at once, and say
+// io.ErrShortBuffer otherwise, so the frame grows until it is.
+func (f *frame) ReadFrom(r io.Reader) (int64, error) {
+	if f.b == nil {
+		return 0, io.ErrClosedPipe
+	}
+	var n int64
+	grow := false
+	for {
+		b := *f.b
+		if grow || cap(b)-len(b) < 512 {
+			nb := make([]byte, len(b), 2*cap(b))
+			copy(nb, b)
+			b, grow = nb, false
+		}
+		m, err := r.Read(b[len(b):cap(b)])
+		*f.b = b[:len(b)+m]
+		n += int64(m)
+		switch {
+		case err == io.EOF:
+			return n, nil
+		case err == io.ErrShortBuffer && m == 0:
+			grow = true
+		case err != nil:
+			return n, err
+		}
+	}
+}
+
+// Close sends the packet and gives the frame's buffer back. Closing a frame
+// again does nothing.
+func (f *frame) Close() error {
+	if f.b == nil {
+		return nil
+	}
+	b := *f.b
+	defer func() {
+		// Even if the write fails, nothing of this packet can leak into
+		// another: the buffer is only reused from the header on.
+		if cap(b) <= maxPooled {
+			*f.b = b[:hdrSize]
+			framePool.Put(f.b)
+		}
+		f.b = nil
+	}()
+	c := f.c
+	if c.Chatty && len(b) > hdrSize+1 {
+		log.Printf("<- len:%d kind:%x tag:%x\n", len(b)-hdrSize, b[hdrSize], b[hdrSize+1])
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Filters are run under the lock, so they see packets in the order
+	// they're sent.
+	if len(c.filter) == 0 {
+		be.PutUint32(b, uint32(len(b)-hdrSize))
+		_, err := c.w.Write(b)
+		return err
 	}
+	d := b[hdrSize:]
+	for _, flt := range c.filter {
+		var err error
+		if d, err = flt.Encode(nil, d); err != nil {
+			return err
+		}
+	}
+	// The encoded packet is somewhere else; send the header from the front
+	// of the frame, and both in one go.
+	be.PutUint32(b, uint32(len(d)))
+	bufs := net.Buffers{b[:hdrSize], d}
+	_, err := bufs.WriteTo(c.w)
+	return err
 }
 
 // Dechunker reads venti-format packets.
@@ -154,7 +261,22 @@ type Dechunker struct {
 	sync.Mutex
 	r      *bufio.Reader
 	remain int
+	hdr    [4]byte
 	Chatty bool
+
+	// Filter holds a []Filter. It's an atomic.Value so Push doesn't need
+	// the lock, which a Read waiting on the next packet holds.
+	filter atomic.Value
+	// Pkt is the rest of the current packet, if it was decoded.
+	pkt []byte
+}
+
+// Push adds f to the Filters packets are decoded with. The next packet read
+// is the first affected; a Read already waiting for a packet's length will
+// decode it.
+func (d *Dechunker) Push(f Filter) {
+	fs, _ := d.filter.Load().([]Filter)
+	d.filter.Store(append(fs[:len(fs):len(fs)], f))
 }
 
 // Dechunk return a Dechunker reading from 'r'.
@@ -174,7 +296,9 @@ func (d *Dechunker) Line() (string, error) {
 
 // Read reads until the end of the message.
 //
-// A Read call after an io.EOF is returned will read the next packet.
+// A Read call after an io.EOF is returned will read the next packet. If the
+// underlying Reader ends, Read returns io.ErrUnexpectedEOF, so it can't be
+// mistaken for the end of a packet. Reads can be of any size.
 func (d *Dechunker) Read(b []byte) (int, error) {
 	d.Lock()
 	defer d.Unlock()
@@ -182,23 +306,35 @@ func (d *Dechunker) Read(b []byte) (int, error) {
 		d.remain--
 		return 0, io.EOF
 	}
+	if len(b) == 0 {
+		return 0, nil
+	}
 	if d.remain < 0 {
-		// Use the buffer passed in as scratch space to determine the length of
-		// the message.
-		sz := b[:4]
-	Try:
-		n, err := d.r.Read(sz)
-		if err != nil {
-			return n, err
-		}
-		if n < 4 {
-			sz = sz[n:]
-			goto Try
+		// The length can arrive in pieces.
+		if _, err := io.ReadFull(d.r, d.hdr[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
 		}
-		d.remain = int(binary.BigEndian.Uint32(b[:4]))
+		d.remain = int(binary.BigEndian.Uint32(d.hdr[:]))
 		if d.Chatty {
 			log.Printf("-> len:%d \n", d.remain)
 		}
+		if fs, _ := d.filter.Load().([]Filter); len(fs) != 0 {
+			if err := d.decode(fs); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if d.pkt != nil {
+		n := copy(b, d.pkt)
+		d.pkt = d.pkt[n:]
+		d.remain -= n
+		if d.remain == 0 {
+			d.pkt = nil
+		}
+		return n, nil
 	}
 
 	if len(b) > d.remain {
@@ -207,5 +343,32 @@ func (d *Dechunker) Read(b []byte) (int, error) {
 
 	n, err := d.r.Read(b)
 	d.remain -= n
+	if err == io.EOF {
+		// The packet was cut short.
+		err = io.ErrUnexpectedEOF
+	}
 	return n, err
 }
+
+// Decode reads the whole of the current packet and runs it back through the
+// Filters.
+func (d *Dechunker) decode(fs []Filter) error {
+	if d.remain > maxPacket {
+		return fmt.Errorf("pack: %d byte packet is bigger than %d", d.remain, maxPacket)
+	}
+	p := make([]byte, d.remain)
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return err
+	}
+	for i := len(fs) - 1; i >= 0; i-- {
+		var err error
+		if p, err = fs[i].Decode(nil, p); err != nil {
+			return err
+		}
+	}
+	d.pkt, d.remain = p, len(p)
+	if len(p) == 0 {
+		d.pkt = nil
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package pack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func writePacket(t *testing.T, c *Chunker, p []byte) {
+	w := c.New()
+	w.Write(p)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPacket(t *testing.T, d *Dechunker) []byte {
+	b, err := ioutil.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Packets have to come out whole however the bytes arrive.
+func TestDechunkShortReads(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c := Chunk(buf)
+	pkts := [][]byte{[]byte("one"), {}, bytes.Repeat([]byte("two"), 1000)}
+	for _, p := range pkts {
+		writePacket(t, c, p)
+	}
+	d := Dechunk(iotest.OneByteReader(buf))
+	for _, p := range pkts {
+		if got := readPacket(t, d); !bytes.Equal(p, got) {
+			t.Fatalf("exp %d bytes, got %d", len(p), len(got))
+		}
+	}
+}
+
+// The end of the connection isn't an empty packet.
+func TestDechunkEnd(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writePacket(t, Chunk(buf), nil)
+	d := Dechunk(buf)
+	if got := readPacket(t, d); len(got) != 0 {
+		t.Fatalf("exp an empty packet, got %d bytes", len(got))
+	}
+	if _, err := ioutil.ReadAll(d); err != io.ErrUnexpectedEOF {
+		t.Fatalf("exp %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestDechunkTruncated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writePacket(t, Chunk(buf), []byte("cut short"))
+	d := Dechunk(bytes.NewReader(buf.Bytes()[:8]))
+	if _, err := ioutil.ReadAll(d); err != io.ErrUnexpectedEOF {
+		t.Fatalf("exp %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+// Small reads have to work, even for the length.
+func TestDechunkSmallReads(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writePacket(t, Chunk(buf), []byte("byte by byte"))
+	d := Dechunk(buf)
+	var got []byte
+	b := make([]byte, 1)
+	for {
+		n, err := d.Read(b)
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got) != "byte by byte" {
+		t.Fatalf("exp %q, got %q", "byte by byte", got)
+	}
+}
+
+// Frames in flight at once mustn't share buffers, and a frame closed twice
+// mustn't be pooled twice.
+func TestChunkConcurrent(t *testing.T) {
+	pr, pw := io.Pipe()
+	c, d := Chunk(pw), Dechunk(pr)
+	const n = 64
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := c.New()
+				w.Write(bytes.Repeat([]byte{byte(i)}, 100+i*97))
+				w.Close()
+				w.Close()
+				if _, err := w.Write([]byte{0}); err == nil {
+					t.Error("wrote to a closed frame")
+				}
+			}(i)
+		}
+		wg.Wait()
+		pw.Close()
+	}()
+	seen := make(map[byte]bool)
+	for i := 0; i < n; i++ {
+		p := readPacket(t, d)
+		if len(p) == 0 || !bytes.Equal(p, bytes.Repeat(p[:1], len(p))) || len(p) != 100+int(p[0])*97 {
+			t.Fatalf("mangled packet of %d bytes", len(p))
+		}
+		seen[p[0]] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("exp %d distinct packets, got %d", n, len(seen))
+	}
+}
+
+func TestFlate(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c, d := Chunk(buf), Dechunk(buf)
+	big := bytes.Repeat([]byte("venti "), 10000)
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(i * 7919 >> 3)
+	}
+
+	// Filters only apply from when they're pushed.
+	writePacket(t, c, []byte("hello"))
+	if got := readPacket(t, d); string(got) != "hello" {
+		t.Fatalf("exp %q, got %q", "hello", got)
+	}
+	c.Push(Flate())
+	d.Push(Flate())
+
+	for _, p := range [][]byte{[]byte("small"), big, random, {}} {
+		writePacket(t, c, p)
+		if len(p) == len(big) && buf.Len() > len(big)/10 {
+			t.Fatalf("%d bytes compressed to %d", len(big), buf.Len())
+		}
+		if got := readPacket(t, d); !bytes.Equal(p, got) {
+			t.Fatalf("exp %d bytes, got %d", len(p), len(got))
+		}
+	}
+}
+
+func TestFlateBad(t *testing.T) {
+	f := Flate()
+	for _, p := range [][]byte{{}, {0x07, 0x00}, {flateDeflated, 0xff, 0xff}} {
+		if _, err := f.Decode(nil, p); err == nil {
+			t.Errorf("%x: wanted an error, didn't get one", p)
+		}
+	}
+}
+
+// A filtered packet's length is checked before it's read.
+func TestDechunkHuge(t *testing.T) {
+	d := Dechunk(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	d.Push(Flate())
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := d.Read(make([]byte, 10)); err == nil {
+		t.Fatal("wanted an error, didn't get one")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes refusing a packet", n)
+	}
+}
+
+func newGCM(t *testing.T, key byte) cipher.AEAD {
+	b, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAEAD(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c, d := Chunk(buf), Dechunk(buf)
+	c.Push(Flate())
+	c.Push(AEAD(newGCM(t, 1)))
+	d.Push(Flate())
+	d.Push(AEAD(newGCM(t, 1)))
+
+	secret := bytes.Repeat([]byte("attack at dawn "), 100)
+	for i := 0; i < 3; i++ {
+		writePacket(t, c, secret)
+		if bytes.Contains(buf.Bytes(), []byte("attack")) {
+			t.Fatal("plaintext on the wire")
+		}
+		if got := readPacket(t, d); !bytes.Equal(secret, got) {
+			t.Fatalf("exp %d bytes, got %d", len(secret), len(got))
+		}
+	}
+}
+
+func TestAEADBad(t *testing.T) {
+	seal := AEAD(newGCM(t, 1))
+	p0, err := seal.Encode(nil, []byte("zero"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := seal.Encode(nil, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of order, with the wrong key, and tampered with.
+	if _, err := AEAD(newGCM(t, 1)).Decode(nil, p1); err == nil {
+		t.Error("opened a reordered packet")
+	}
+	if _, err := AEAD(newGCM(t, 2)).Decode(nil, p0); err == nil {
+		t.Error("opened a packet with the wrong key")
+	}
+	p0[0] ^= 1
+	if _, err := AEAD(newGCM(t, 1)).Decode(nil, p0); err == nil {
+		t.Error("opened a tampered packet")
+	}
+}
+
+func benchmarkChunk(b *testing.B, sz int, fs ...Filter) {
+	c := Chunk(ioutil.Discard)
+	for _, f := range fs {
+		c.Push(f)
+	}
+	p := bytes.Repeat([]byte("venti"), sz/5)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := c.New()
+		w.Write(p)
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunkSmall(b *testing.B) { benchmarkChunk(b, 40) }
+func BenchmarkChunkBlock(b *testing.B) { benchmarkChunk(b, 56*1024) }
+func BenchmarkChunkFlate(b *testing.B) { benchmarkChunk(b, 56*1024, Flate()) }
+
+// BenchmarkChunkCopy is how messages are sent: copied in from their Read
+// methods.
+func BenchmarkChunkCopy(b *testing.B) {
+	c := Chunk(ioutil.Discard)
+	p := bytes.Repeat([]byte("venti"), 1000)
+	r := bytes.NewReader(p)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(p)
+		w := c.New()
+		if _, err := io.Copy(w, r); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package kvfs is a venti.Handler that keeps every block in a single file.
+
+The file is an append-only log of records, each of which is:
+
+	score[20] type[1] size[4] crc[4] data[size]
+
+The crc is a CRC-32C (Castagnoli) of everything before it in the record plus
+the data. The index from score and type to record is kept in memory and
+rebuilt by scanning the log when the file is opened.
+
+Writes are batched in memory until Sync, which appends the batch in one write
+and fsyncs the file. If the process dies mid-append, the torn record at the end
+is short or fails its checksum, and is cut off the next time the file is
+opened, so a block is either wholly present or absent. A bad record anywhere
+else is corruption: Open fails, naming its offset, and leaves the file alone.
+*/
+package kvfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hdonnay/venti"
+)
+
+const (
+	magic = "vkv1"
+	// hdrSz is the size of a record header.
+	hdrSz = sha1.Size + 1 + 4 + 4
+	// maxBatch is how big a batch can get before it's written out without
+	// waiting for a Sync. It's still not fsync'd until then.
+	maxBatch = 4 << 20
+)
+
+var (
+	be  = binary.BigEndian
+	tab = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Store is an open kvfs file.
+type Store struct {
+	mu *sync.RWMutex
+	f  *os.File
+	// end is the offset the next record will be written at.
+	end int64
+	// index maps a key to where its record starts, and types a score to
+	// one of the types it's stored as.
+	index map[string]int64
+	types map[string]venti.Type
+
+	// batch is the records not yet written to f. pending indexes it.
+	batch   *bytes.Buffer
+	pending map[string]int
+}
+
+// Open opens the store at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		mu:      &sync.RWMutex{},
+		f:       f,
+		index:   make(map[string]int64),
+		types:   make(map[string]venti.Type),
+		batch:   &bytes.Buffer{},
+		pending: make(map[string]int),
+	}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load checks the magic, scans the log to build the index, and cuts off any
+// torn record at the end. A bad record with more after it is an error.
+func (s *Store) load() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		if _, err := s.f.Write([]byte(magic)); err != nil {
+			return err
+		}
+		s.end = int64(len(magic))
+		return s.f.Sync()
+	}
+
+	r := bufio.NewReader(s.f)
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, m); err != nil || string(m) != magic {
+		return fmt.Errorf("kvfs: %s: not a kvfs file", s.f.Name())
+	}
+	off := int64(len(magic))
+	hdr := make([]byte, hdrSz)
+	var data []byte
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		sz := be.Uint32(hdr[21:25])
+		end := off + hdrSz + int64(sz)
+		if end > fi.Size() {
+			break
+		}
+		if cap(data) < int(sz) {
+			data = make([]byte, sz)
+		}
+		data = data[:sz]
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if crc(hdr[:25], data) != be.Uint32(hdr[25:29]) {
+			if end == fi.Size() {
+				break
+			}
+			return fmt.Errorf("kvfs: %s: bad checksum in record at %d", s.f.Name(), off)
+		}
+		s.index[string(hdr[:sha1.Size+1])] = off
+		s.types[string(hdr[:sha1.Size])] = venti.Type(hdr[20])
+		off += hdrSz + int64(sz)
+	}
+	if off != fi.Size() {
+		if err := s.f.Truncate(off); err != nil {
+			return err
+		}
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	}
+	s.end = off
+	return nil
+}
+
+// Key is what a block is indexed by: its score, then its type, as at the
+// start of its record.
+func key(sc venti.Score, k venti.Type) string {
+	return string(sc) + string([]byte{byte(k)})
+}
+
+func crc(hdr, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(hdr, tab), tab, data)
+}
+
+// Handshake is a venti.Handshake that serves every client from s.
+func (s *Store) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, s, nil
+}
+
+// Read returns the block, out of the batch or the file.
+func (s *Store) Read(sc venti.Score, k venti.Type, _ int64) (io.Reader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off, ok := s.pending[key(sc, k)]; ok {
+		// The batch gets reused once it's flushed, so copy the block out.
+		b := s.batch.Bytes()[off:]
+		sz := be.Uint32(b[21:25])
+		return bytes.NewReader(append([]byte(nil), b[hdrSz:hdrSz+sz]...)), nil
+	}
+	off, ok := s.index[key(sc, k)]
+	if !ok {
+		if t, ok := s.types[string(sc)]; ok {
+			return nil, venti.CheckType(sc, t, k)
+		}
+		return nil, venti.NotFound(sc, k)
+	}
+	_, sz, err := s.header(off)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(s.f, off+hdrSz, int64(sz)), nil
+}
+
+// Has reports whether the block is in the batch or the file.
+func (s *Store) Has(sc venti.Score, k venti.Type) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.pending[key(sc, k)]; ok {
+		return true, nil
+	}
+	_, ok := s.index[key(sc, k)]
+	return ok, nil
+}
+
+// Header reads the type and size out of the record at off.
+func (s *Store) header(off int64) (venti.Type, uint32, error) {
+	hdr := make([]byte, hdrSz)
+	if _, err := s.f.ReadAt(hdr, off); err != nil {
+		return 0, 0, fmt.Errorf("kvfs: record at %d: %v", off, err)
+	}
+	return venti.Type(hdr[20]), be.Uint32(hdr[21:25]), nil
+}
+
+// Write adds the block to the batch.
+func (s *Store) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	data := &bytes.Buffer{}
+	h := sha1.New()
+	if _, err := io.Copy(data, io.TeeReader(r, h)); err != nil {
+		return nil, err
+	}
+	sc := venti.Score(h.Sum(nil))
+
+	hdr := make([]byte, hdrSz)
+	copy(hdr, sc)
+	hdr[20] = byte(k)
+	be.PutUint32(hdr[21:25], uint32(data.Len()))
+	be.PutUint32(hdr[25:29], crc(hdr[:25], data.Bytes()))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[key(sc, k)]; ok {
+		return sc, nil
+	}
+	if _, ok := s.pending[key(sc, k)]; ok {
+		return sc, nil
+	}
+	s.pending[key(sc, k)] = s.batch.Len()
+	s.types[string(sc)] = k
+	s.batch.Write(hdr)
+	s.batch.Write(data.Bytes())
+	if s.batch.Len() > maxBatch {
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+// Flush appends the batch to the file. The caller must hold the lock.
+func (s *Store) flush() error {
+	if s.batch.Len() == 0 {
+		return nil
+	}
+	if _, err := s.f.WriteAt(s.batch.Bytes(), s.end); err != nil {
+		// Whatever made it out is garbage now; the next flush overwrites it,
+		// and load would cut it off.
+		return err
+	}
+	for k, off := range s.pending {
+		s.index[k] = s.end + int64(off)
+	}
+	s.end += int64(s.batch.Len())
+	s.batch.Reset()
+	s.pending = make(map[string]int)
+	return nil
+}
+
+// Sync writes out the batch and fsyncs the file.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Walk calls fn for every block in s, stopping at the first error.
+func (s *Store) Walk(fn func(venti.Score, venti.Type, int64) error) error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	idx := make(map[string]int64, len(s.index))
+	for k, off := range s.index {
+		idx[k] = off
+	}
+	s.mu.RUnlock()
+	for k, off := range idx {
+		t, sz, err := s.header(off)
+		if err != nil {
+			return err
+		}
+		if err := fn(venti.Score(k[:sha1.Size]), t, int64(sz)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the file.
+func (s *Store) Close() error {
+	if err := s.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
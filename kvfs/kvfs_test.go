@@ -0,0 +1,200 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package kvfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func tmpStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kvfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "store"), func() { os.RemoveAll(dir) }
+}
+
+func TestHandler(t *testing.T) {
+	p, done := tmpStore(t)
+	defer done()
+	s, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ventitest.TestHandler(t, s)
+}
+
+func write(t *testing.T, s *Store, d []byte) venti.Score {
+	sc, err := s.Write(venti.VtData, bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+func read(t *testing.T, s *Store, sc venti.Score) []byte {
+	r, err := s.Read(sc, venti.VtData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReopen(t *testing.T) {
+	p, done := tmpStore(t)
+	defer done()
+	s, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		d := []byte(fmt.Sprint("block ", i))
+		data[string(write(t, s, d))] = d
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for sc, d := range data {
+		if got := read(t, s, venti.Score(sc)); !bytes.Equal(d, got) {
+			t.Fatalf("exp %q, got %q", d, got)
+		}
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	p, done := tmpStore(t)
+	defer done()
+	s, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep := write(t, s, []byte("keep"))
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	lose := write(t, s, []byte("lose this one"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chop the last record in half, as if we crashed mid-append.
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(p, fi.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := read(t, s, keep); string(got) != "keep" {
+		t.Fatalf("exp %q, got %q", "keep", got)
+	}
+	if _, err := s.Read(lose, venti.VtData, 1024); !errors.Is(err, venti.ErrNotFound) {
+		t.Fatalf("exp %v, got %v", venti.ErrNotFound, err)
+	}
+	// The store should be usable after recovery.
+	again := write(t, s, []byte("lose this one"))
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, again); string(got) != "lose this one" {
+		t.Fatalf("exp %q, got %q", "lose this one", got)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	p, done := tmpStore(t)
+	defer done()
+	s, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sc := write(t, s, []byte("batched"))
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(magic)) {
+		t.Fatalf("write reached the file before Sync: size %d", fi.Size())
+	}
+	if got := read(t, s, sc); string(got) != "batched" {
+		t.Fatalf("exp %q, got %q", "batched", got)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, sc); string(got) != "batched" {
+		t.Fatalf("exp %q, got %q", "batched", got)
+	}
+}
+
+// A bad record with good ones after it isn't a torn write, so the file is
+// left alone rather than losing them.
+func TestCorruptMiddle(t *testing.T) {
+	p, done := tmpStore(t)
+	defer done()
+	s, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"first", "second", "third"} {
+		write(t, s, []byte(d))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(magic)+hdrSz] ^= 0xff
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := Open(p); err == nil {
+		s.Close()
+		t.Fatal("opened a store with a corrupt record")
+	} else if exp := fmt.Sprintf("record at %d", len(magic)); !strings.Contains(err.Error(), exp) {
+		t.Fatalf("exp an error naming %q, got %v", exp, err)
+	}
+	after, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, b) {
+		t.Fatalf("file changed: %d bytes, was %d", len(after), len(b))
+	}
+}
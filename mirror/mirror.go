@@ -0,0 +1,334 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package mirror is a venti.Handler that replicates blocks across several
+Handlers.
+
+Blocks are content-addressed, so replicas can't conflict: a replica either has
+the right data for a score or it's broken. Writes go to every replica and
+succeed once a quorum agree on the score. Reads go to the first healthy
+replica that has the block, and the data is checked against the score before
+it's returned.
+*/
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/hdonnay/venti"
+)
+
+// ScoreError reports a replica disagreeing about a block's score.
+type ScoreError struct {
+	Replica  int
+	Exp, Got venti.Score
+}
+
+func (e *ScoreError) Error() string {
+	return fmt.Sprintf("mirror: replica %d: score %v, expected %v", e.Replica, e.Got, e.Exp)
+}
+
+// Mirror is the replicating Handler.
+type Mirror struct {
+	r      []venti.Handler
+	quorum int
+
+	mu *sync.Mutex
+	// seq numbers the Writes, and writing holds those whose replica writes
+	// are still running, including after Write has returned. Done is
+	// signalled as each finishes.
+	seq     uint64
+	writing map[uint64]bool
+	done    *sync.Cond
+	// sick is set for replicas whose last operation failed. They're tried
+	// last.
+	sick []bool
+	// errs holds failures from writes that otherwise made quorum.
+	errs []error
+}
+
+// New returns a Mirror over the replicas r. Writes need quorum matching
+// scores to succeed; a quorum less than 1 means all of them.
+func New(quorum int, r ...venti.Handler) *Mirror {
+	if quorum < 1 || quorum > len(r) {
+		quorum = len(r)
+	}
+	m := &Mirror{
+		r:       r,
+		quorum:  quorum,
+		mu:      &sync.Mutex{},
+		writing: make(map[uint64]bool),
+		sick:    make([]bool, len(r)),
+	}
+	m.done = sync.NewCond(m.mu)
+	return m
+}
+
+// Handshake is a venti.Handshake that serves every client from m.
+func (m *Mirror) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, m, nil
+}
+
+func (m *Mirror) mark(i int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sick[i] = err != nil
+}
+
+// Order returns the replica indexes, healthy ones first.
+func (m *Mirror) order() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := make([]int, 0, len(m.r))
+	for i, s := range m.sick {
+		if !s {
+			o = append(o, i)
+		}
+	}
+	for i, s := range m.sick {
+		if s {
+			o = append(o, i)
+		}
+	}
+	return o
+}
+
+// Read returns the block from the first replica that has it intact.
+func (m *Mirror) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	var errs []error
+	for _, i := range m.order() {
+		b, err := m.read(i, s, k, ct)
+		m.mark(i, err)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return bytes.NewReader(b), nil
+	}
+	return nil, readError("mirror", errs)
+}
+
+// Has asks the replicas in turn, stopping at the first that has the block.
+// A replica that fails is marked as for Read, but one that doesn't have the
+// block isn't. If none has it and any failed, the errors are returned.
+func (m *Mirror) Has(s venti.Score, k venti.Type) (bool, error) {
+	var errs []error
+	for _, i := range m.order() {
+		ok, err := venti.Has(m.r[i], s, k)
+		m.mark(i, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	if len(errs) != 0 {
+		return false, joinError("mirror", errs)
+	}
+	return false, nil
+}
+
+func (m *Mirror) read(i int, s venti.Score, k venti.Type, ct int64) ([]byte, error) {
+	r, err := m.r[i].Read(s, k, ct)
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replica %d: %w", i, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("replica %d: %w", i, err)
+	}
+	if len(s) == sha1.Size {
+		if got := sha1.Sum(b); !bytes.Equal(got[:], s) {
+			return nil, &ScoreError{Replica: i, Exp: s, Got: got[:]}
+		}
+	}
+	return b, nil
+}
+
+// Write sends the block to every replica and returns once a quorum have
+// stored it. Replicas that are still going finish in the background; Sync
+// waits for them.
+func (m *Mirror) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(b)
+	exp := venti.Score(sum[:])
+
+	m.mu.Lock()
+	m.seq++
+	seq := m.seq
+	m.writing[seq] = true
+	m.mu.Unlock()
+
+	res := make(chan error, len(m.r))
+	for i := range m.r {
+		go func(i int) {
+			s, err := m.r[i].Write(k, bytes.NewReader(b))
+			if err == nil && !bytes.Equal(s, exp) {
+				err = &ScoreError{Replica: i, Exp: exp, Got: s}
+			} else if err != nil {
+				err = fmt.Errorf("replica %d: %w", i, err)
+			}
+			m.mark(i, err)
+			res <- err
+		}(i)
+	}
+
+	ok := 0
+	var errs []error
+	for n := range m.r {
+		err := <-res
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			ok++
+		}
+		if ok >= m.quorum {
+			// Failures so far, and anything still outstanding, report to
+			// Sync.
+			m.mu.Lock()
+			m.errs = append(m.errs, errs...)
+			m.mu.Unlock()
+			go m.collect(seq, res, len(m.r)-n-1)
+			return exp, disagreement(errs)
+		}
+		if len(m.r)-len(errs) < m.quorum {
+			go m.collect(seq, res, len(m.r)-n-1)
+			return nil, joinError("mirror: no quorum", errs)
+		}
+	}
+	panic("unreachable")
+}
+
+// Disagreement returns the first ScoreError in errs. A replica returning the
+// wrong score is worth reporting even if the quorum was met.
+func disagreement(errs []error) error {
+	for _, err := range errs {
+		if _, ok := err.(*ScoreError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collect waits for the last n replica writes of Write seq, then marks it
+// finished.
+func (m *Mirror) collect(seq uint64, res chan error, n int) {
+	var errs []error
+	for ; n > 0; n-- {
+		if err := <-res; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs = append(m.errs, errs...)
+	delete(m.writing, seq)
+	m.done.Broadcast()
+}
+
+// WritingBefore reports whether any Write up to seq is still running. The
+// caller must hold the lock.
+func (m *Mirror) writingBefore(seq uint64) bool {
+	for s := range m.writing {
+		if s <= seq {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync waits for the replica writes of every Write started before it was
+// called, and then syncs every replica. It fails if fewer than a quorum of
+// replicas synced, or if any replica failed a write since the last Sync.
+func (m *Mirror) Sync() error {
+	m.mu.Lock()
+	seq := m.seq
+	for m.writingBefore(seq) {
+		m.done.Wait()
+	}
+	m.mu.Unlock()
+
+	res := make(chan error, len(m.r))
+	for i := range m.r {
+		go func(i int) {
+			err := m.r[i].Sync()
+			if err != nil {
+				err = fmt.Errorf("replica %d: %w", i, err)
+			}
+			m.mark(i, err)
+			res <- err
+		}(i)
+	}
+	ok := 0
+	var errs []error
+	for range m.r {
+		if err := <-res; err != nil {
+			errs = append(errs, err)
+		} else {
+			ok++
+		}
+	}
+	if ok < m.quorum {
+		return joinError("mirror: no quorum", errs)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.errs) != 0 {
+		err := joinError("mirror", m.errs)
+		m.errs = nil
+		return err
+	}
+	return nil
+}
+
+// ReadError reports a read that failed on every replica. One error is
+// wrapped, so errors.Is sees it: the first that isn't venti.ErrNotFound, since
+// a replica that hasn't caught up with a write says less than one that has
+// the block.
+func readError(prefix string, errs []error) error {
+	if len(errs) == 0 {
+		return fmt.Errorf("%s: no replicas", prefix)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, venti.ErrNotFound) {
+			errs = append([]error{err}, append(errs[:i:i], errs[i+1:]...)...)
+			break
+		}
+	}
+	return joinError(prefix, errs)
+}
+
+// JoinError reports every error in errs, wrapping the first so errors.Is
+// sees it.
+func joinError(prefix string, errs []error) error {
+	if len(errs) == 1 {
+		return fmt.Errorf("%s: %w", prefix, errs[0])
+	}
+	return fmt.Errorf("%s: %w (also: %s)", prefix, errs[0], join(errs[1:]))
+}
+
+func join(errs []error) string {
+	s := make([]string, len(errs))
+	for i, err := range errs {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
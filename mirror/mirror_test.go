@@ -0,0 +1,300 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+var errDown = fmt.Errorf("down")
+
+func TestHandler(t *testing.T) {
+	m := New(2, ventitest.NewMemFS(), ventitest.NewMemFS(), ventitest.NewMemFS())
+	ventitest.TestHandler(t, m)
+}
+
+func TestQuorum(t *testing.T) {
+	b := []byte("quorum")
+
+	m := New(2, ventitest.NewMemFS(), ventitest.NewErrFS(errDown), ventitest.NewMemFS())
+	if _, err := m.Write(venti.VtData, bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sync(); err == nil {
+		t.Fatal("wanted an error from the failed replica, didn't get one")
+	}
+	// A quorum synced, and the failure has been reported.
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = New(2, ventitest.NewMemFS(), ventitest.NewErrFS(errDown), ventitest.NewErrFS(errDown))
+	if _, err := m.Write(venti.VtData, bytes.NewReader(b)); err == nil {
+		t.Fatal("wanted an error, didn't get one")
+	}
+}
+
+// Errors from the replicas can be matched with errors.Is.
+func TestErrorsIs(t *testing.T) {
+	ro := ventitest.NewErrFS(venti.ErrReadOnly)
+	m := New(2, ventitest.NewMemFS(), ro, ro)
+	if _, err := m.Write(venti.VtData, bytes.NewReader([]byte("is"))); !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+	if err := m.Sync(); !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+	sc := sha1.Sum([]byte("missing"))
+	if _, err := m.Read(sc[:], venti.VtData, 7); !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+
+	m = New(1, ventitest.NewMemFS(), ventitest.NewMemFS())
+	if _, err := m.Read(sc[:], venti.VtData, 7); !errors.Is(err, venti.ErrNotFound) {
+		t.Fatalf("exp %v, got %v", venti.ErrNotFound, err)
+	}
+}
+
+// liar returns the wrong score for every write, and garbage for every read.
+type liar struct{}
+
+func (liar) Read(_ venti.Score, _ venti.Type, _ int64) (io.Reader, error) {
+	return bytes.NewReader([]byte("garbage")), nil
+}
+
+func (liar) Write(_ venti.Type, r io.Reader) (venti.Score, error) {
+	io.Copy(ioutil.Discard, r)
+	return venti.Score(make([]byte, sha1.Size)), nil
+}
+
+func (liar) Sync() error { return nil }
+
+func TestDisagree(t *testing.T) {
+	m := New(1, liar{}, ventitest.NewMemFS())
+	_, err := m.Write(venti.VtData, bytes.NewReader([]byte("disagree")))
+	// The honest replica may make quorum before the liar answers.
+	if _, ok := err.(*ScoreError); err != nil && !ok {
+		t.Fatalf("wanted a ScoreError, got %v", err)
+	}
+	if err := m.Sync(); err == nil {
+		t.Fatal("wanted an error, didn't get one")
+	}
+}
+
+// A replica that's behind says less than one that has the block as another
+// type, so its ErrNotFound doesn't hide the mismatch.
+func TestReadErrorOrder(t *testing.T) {
+	behind, ahead := ventitest.NewMemFS(), ventitest.NewMemFS()
+	s, err := ahead.Write(venti.VtDir, bytes.NewReader([]byte("entries")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(1, behind, ahead)
+	_, err = m.Read(s, venti.VtData, 7)
+	if !errors.Is(err, venti.ErrTypeMismatch) {
+		t.Fatalf("exp %v, got %v", venti.ErrTypeMismatch, err)
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	b := []byte("fallback")
+	good := ventitest.NewMemFS()
+	s, err := good.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(1, ventitest.NewMemFS(), liar{}, good)
+	r, err := m.Read(s, venti.VtData, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatalf("exp %q, got %q", b, got)
+	}
+	// Both bad replicas should now be tried last.
+	if o := m.order(); o[0] != 2 {
+		t.Fatalf("exp replica 2 first, got order %v", o)
+	}
+}
+
+// Remote starts n servers and returns Handlers for Clients of them, and a
+// cleanup function.
+func remote(t *testing.T, n int) ([]venti.Handler, func()) {
+	var hs []venti.Handler
+	var cs []io.Closer
+	done := func() {
+		for _, c := range cs {
+			c.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			done()
+			t.Fatal(err)
+		}
+		cs = append(cs, l)
+		go venti.Serve(l, ventitest.NewMemFS().Handshake)
+		c, err := venti.Dial(l.Addr().String())
+		if err != nil {
+			done()
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+		hs = append(hs, c.Handler())
+	}
+	return hs, done
+}
+
+func TestRemote(t *testing.T) {
+	hs, done := remote(t, 3)
+	defer done()
+	ventitest.TestHandler(t, New(2, hs...))
+}
+
+// Has over Clients asks the servers, and a block that's missing or stored
+// as another type doesn't make a replica sick.
+func TestRemoteHas(t *testing.T) {
+	hs, done := remote(t, 3)
+	defer done()
+	m := New(2, hs...)
+
+	b := []byte("remote has")
+	s, err := m.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	missing := sha1.Sum([]byte("missing"))
+	for _, tc := range []struct {
+		s   venti.Score
+		k   venti.Type
+		exp bool
+	}{
+		{s, venti.VtData, true},
+		{s, venti.VtDir, false},
+		{missing[:], venti.VtData, false},
+	} {
+		ok, err := m.Has(tc.s, tc.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.exp {
+			t.Errorf("Has(%v, %d): exp %v, got %v", tc.s, tc.k, tc.exp, ok)
+		}
+	}
+	for i, sick := range m.sick {
+		if sick {
+			t.Errorf("replica %d marked sick", i)
+		}
+	}
+}
+
+// Writes and Syncs from many connections at once.
+func TestConcurrentSync(t *testing.T) {
+	m := New(2, ventitest.NewMemFS(), ventitest.NewMemFS(), ventitest.NewMemFS())
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				b := []byte(fmt.Sprintf("writer %d block %d", i, j))
+				if _, err := m.Write(venti.VtData, bytes.NewReader(b)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := m.Sync(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// GateFS holds writes of the blocks in wait until their channels are
+// closed.
+type gateFS struct {
+	*ventitest.MemFS
+	wait map[string]chan struct{}
+}
+
+func (g *gateFS) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if ch, ok := g.wait[string(b)]; ok {
+		<-ch
+	}
+	return g.MemFS.Write(k, bytes.NewReader(b))
+}
+
+// Sync waits for the writes before it, but not ones started after.
+func TestSyncOnlyEarlier(t *testing.T) {
+	before, after := make(chan struct{}), make(chan struct{})
+	g := &gateFS{
+		MemFS: ventitest.NewMemFS(),
+		wait:  map[string]chan struct{}{"before": before, "after": after},
+	}
+	defer close(after)
+	m := New(1, ventitest.NewMemFS(), g)
+
+	if _, err := m.Write(venti.VtData, bytes.NewReader([]byte("before"))); err != nil {
+		t.Fatal(err)
+	}
+	synced := make(chan error, 1)
+	go func() { synced <- m.Sync() }()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := m.Write(venti.VtData, bytes.NewReader([]byte("after"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-synced:
+		t.Fatalf("Sync returned before an earlier write finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(before)
+	select {
+	case err := <-synced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync waited for a later write")
+	}
+}
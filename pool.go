@@ -0,0 +1,349 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// PoolConfig is the settings for a Pool.
+type PoolConfig struct {
+	// Size is the number of connections. If zero, 4 are used.
+	Size int
+	// Idle is how long a connection goes unused before it's pinged, and
+	// how long the ping may take. If zero, 30 seconds is used.
+	Idle time.Duration
+
+	// Dialer and Client are used for each connection, as in DialContext.
+	Dialer *net.Dialer
+	Client *ClientConfig
+}
+
+// Pool is a set of connections to one server, with requests spread across
+// them round-robin. It's for when one connection, with its 256 outstanding
+// requests, isn't enough.
+//
+// Connections that fail, or that don't answer a ping after being idle, are
+// closed and redialed in the background. A connection with a request or a
+// Read body still open isn't idle, however long it takes. Requests in flight on them fail;
+// new ones go to the other connections.
+type Pool struct {
+	addr string
+	cfg  PoolConfig
+
+	mu     sync.Mutex
+	conns  []*poolConn
+	next   int
+	err    error // The last dial error.
+	closed bool
+
+	kick chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type poolConn struct {
+	c    *Client // Nil until dialed.
+	used time.Time
+	busy int // Requests and Read bodies still open on c.
+}
+
+// NewPool dials cfg.Size connections to addr, a dial string as for DialAddr.
+// A nil cfg is the same as the zero PoolConfig.
+func NewPool(addr string, cfg *PoolConfig) (*Pool, error) {
+	p := &Pool{
+		addr: addr,
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+	if p.cfg.Size <= 0 {
+		p.cfg.Size = 4
+	}
+	if p.cfg.Idle <= 0 {
+		p.cfg.Idle = 30 * time.Second
+	}
+	for i := 0; i < p.cfg.Size; i++ {
+		c, err := p.dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.conns = append(p.conns, &poolConn{c: c, used: time.Now()})
+	}
+	p.wg.Add(1)
+	go p.tend()
+	return p, nil
+}
+
+func (p *Pool) dial() (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Idle)
+	defer cancel()
+	return DialContext(ctx, p.cfg.Dialer, p.addr, p.cfg.Client)
+}
+
+// Get returns the next working connection, marked busy until it's passed
+// to release.
+func (p *Pool) get() (*poolConn, *Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, nil, fmt.Errorf("venti: pool closed")
+	}
+	for range p.conns {
+		p.next = (p.next + 1) % len(p.conns)
+		pc := p.conns[p.next]
+		if pc.c != nil && pc.c.Err() == nil {
+			pc.used = time.Now()
+			pc.busy++
+			return pc, pc.c, nil
+		}
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+	if p.err != nil {
+		return nil, nil, fmt.Errorf("venti: pool: no connections to %s: %w", p.addr, p.err)
+	}
+	return nil, nil, fmt.Errorf("venti: pool: no connections to %s", p.addr)
+}
+
+// Release marks a use of c, from get, finished. If c has been replaced since,
+// there's nothing to do.
+func (p *Pool) release(pc *poolConn, c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc.c == c {
+		pc.busy--
+		pc.used = time.Now()
+	}
+}
+
+// Tend pings idle connections and replaces broken ones, until the Pool is
+// closed.
+func (p *Pool) tend() {
+	defer p.wg.Done()
+	t := time.NewTicker(p.cfg.Idle / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		case <-p.kick:
+		}
+		for i := range p.conns {
+			p.check(i)
+		}
+	}
+}
+
+// Check pings connection i if it's idle, and redials it if it's broken.
+func (p *Pool) check(i int) {
+	p.mu.Lock()
+	pc := p.conns[i]
+	c, idle := pc.c, pc.busy == 0 && time.Since(pc.used) >= p.cfg.Idle
+	p.mu.Unlock()
+
+	if c != nil && c.Err() == nil {
+		if !idle {
+			return
+		}
+		if err := p.ping(c); err == nil {
+			p.mu.Lock()
+			pc.used = time.Now()
+			p.mu.Unlock()
+			return
+		}
+	}
+	if c != nil {
+		c.Close()
+	}
+
+	nc, err := p.dial()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		pc.c, p.err = nil, err
+		return
+	}
+	if p.closed {
+		nc.Close()
+		return
+	}
+	pc.c, pc.used, pc.busy = nc, time.Now(), 0
+}
+
+// Ping pings c, giving up after the idle time.
+func (p *Pool) ping(c *Client) error {
+	errc := make(chan error, 1)
+	go func() { errc <- c.Ping() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(p.cfg.Idle):
+		return fmt.Errorf("venti: ping timed out")
+	}
+}
+
+// Read reads a block on one of the connections, as Client.Read does.
+func (p *Pool) Read(t Type, s Score, ct int64) (io.ReadCloser, error) {
+	pc, c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.Read(t, s, ct)
+	if err != nil {
+		p.release(pc, c)
+		return nil, err
+	}
+	return &poolBody{ReadCloser: r, done: func() { p.release(pc, c) }}, nil
+}
+
+// PoolBody keeps its connection busy until it's read to the end or closed,
+// since the connection can't answer anything else until then.
+type poolBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *poolBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *poolBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// Write writes a block on one of the connections, as Client.Write does.
+func (p *Pool) Write(t Type, r io.Reader) (Score, error) {
+	pc, c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(pc, c)
+	return c.Write(t, r)
+}
+
+// Has reports whether the server has a block, as Client.Has does, on one
+// of the connections.
+func (p *Pool) Has(ctx context.Context, s Score, t Type) (bool, error) {
+	pc, c, err := p.get()
+	if err != nil {
+		return false, err
+	}
+	defer p.release(pc, c)
+	return c.Has(ctx, s, t)
+}
+
+// Ping pings the server on one of the connections.
+func (p *Pool) Ping() error {
+	pc, c, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer p.release(pc, c)
+	return c.Ping()
+}
+
+// Sync syncs every working connection, since a server's Handlers may be
+// per connection.
+func (p *Pool) Sync() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return fmt.Errorf("venti: pool closed")
+	}
+	var cs []*Client
+	for _, pc := range p.conns {
+		if pc.c != nil && pc.c.Err() == nil {
+			cs = append(cs, pc.c)
+		}
+	}
+	p.mu.Unlock()
+	if len(cs) == 0 {
+		pc, c, err := p.get()
+		if err == nil {
+			p.release(pc, c)
+		}
+		return err
+	}
+
+	errs := make(chan error, len(cs))
+	for _, c := range cs {
+		go func(c *Client) { errs <- c.Sync() }(c)
+	}
+	var err error
+	for range cs {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Handler returns a Handler that forwards every operation to the Pool.
+func (p *Pool) Handler() Handler {
+	return poolHandler{p}
+}
+
+type poolHandler struct {
+	p *Pool
+}
+
+func (h poolHandler) Read(s Score, t Type, ct int64) (io.Reader, error) {
+	return h.p.Read(t, s, ct)
+}
+
+func (h poolHandler) Write(t Type, r io.Reader) (Score, error) {
+	return h.p.Write(t, r)
+}
+
+func (h poolHandler) Has(s Score, t Type) (bool, error) {
+	return h.p.Has(context.Background(), s, t)
+}
+
+func (h poolHandler) Sync() error {
+	return h.p.Sync()
+}
+
+// Close closes every connection.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	close(p.done)
+	p.wg.Wait()
+
+	var err error
+	for _, pc := range p.conns {
+		if pc.c == nil {
+			continue
+		}
+		if cerr := pc.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// Tracker keeps the connections a server accepts, so tests can break them.
+type tracker struct {
+	mu    sync.Mutex
+	conns []*stallConn
+}
+
+func (tr *tracker) wrap(nc net.Conn) net.Conn {
+	c := &stallConn{Conn: nc, closed: make(chan struct{})}
+	tr.mu.Lock()
+	tr.conns = append(tr.conns, c)
+	tr.mu.Unlock()
+	return c
+}
+
+func (tr *tracker) accepted() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.conns)
+}
+
+// Each calls f with every connection accepted so far.
+func (tr *tracker) each(f func(*stallConn)) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, c := range tr.conns {
+		f(c)
+	}
+}
+
+// StallConn stops reading once stalled, like a hung server.
+type stallConn struct {
+	net.Conn
+	mu      sync.Mutex
+	stalled bool
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	s := c.stalled
+	c.mu.Unlock()
+	if s {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *stallConn) stall() {
+	c.mu.Lock()
+	c.stalled = true
+	c.mu.Unlock()
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// WaitPing pings until the Pool works again.
+func waitPing(t *testing.T, p *venti.Pool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := p.Ping()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool never recovered: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPool(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	p, err := venti.NewPool(l.Addr().String(), &venti.PoolConfig{Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if n := tr.accepted(); n != 3 {
+		t.Fatalf("exp 3 connections, got %d", n)
+	}
+	ventitest.TestHandler(t, p.Handler())
+}
+
+func TestPoolReplace(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	p, err := venti.NewPool(l.Addr().String(), &venti.PoolConfig{Size: 2, Idle: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tr.each(func(c *stallConn) { c.Close() })
+	waitPing(t, p)
+	if n := tr.accepted(); n <= 2 {
+		t.Fatalf("exp new connections, got %d in all", n)
+	}
+	ventitest.TestHandler(t, p.Handler())
+}
+
+// Connections that stop answering get replaced too.
+func TestPoolStalled(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	p, err := venti.NewPool(l.Addr().String(), &venti.PoolConfig{Size: 2, Idle: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tr.each(func(c *stallConn) { c.stall() })
+	time.Sleep(200 * time.Millisecond)
+	waitPing(t, p)
+	if n := tr.accepted(); n <= 2 {
+		t.Fatalf("exp new connections, got %d in all", n)
+	}
+}
+
+// A Read body left open for a while keeps its connection busy, not idle:
+// nothing else can come back on it until the body's been read.
+func TestPoolSlowRead(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	p, err := venti.NewPool(l.Addr().String(), &venti.PoolConfig{Size: 1, Idle: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	b := bytes.Repeat([]byte("slow reader "), 4096)
+	s, err := p.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Read(venti.VtData, s, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("read back %d bytes, exp %d", len(got), len(b))
+	}
+	if n := tr.accepted(); n != 1 {
+		t.Fatalf("exp 1 connection, got %d", n)
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	p, err := venti.NewPool(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if err := p.Ping(); err == nil {
+		t.Fatal("pinged on a closed pool")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
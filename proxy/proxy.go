@@ -0,0 +1,140 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package proxy is a venti.Handler that forwards requests to upstream venti
+servers.
+
+The first upstream is the primary: writes and syncs go there. Reads try each
+upstream in order, so a proxy over a new server and an old one can be put in
+front of clients while the old server's blocks are migrated.
+*/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hdonnay/venti"
+)
+
+// Proxy is the forwarding Handler.
+type Proxy struct {
+	up []*upstream
+
+	// ReadOnly makes Write fail with venti.ErrReadOnly. It should be set before the
+	// Proxy is used.
+	ReadOnly bool
+}
+
+// Upstream is a pool of connections to one server.
+type upstream struct {
+	addr string
+	p    *venti.Pool
+}
+
+// Dial connects to each of the upstream servers at addrs, making n
+// connections to each. The addrs are dial strings, as for venti.DialAddr.
+// Connections that break are replaced in the background.
+func Dial(addrs []string, n int) (*Proxy, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("proxy: no upstream servers")
+	}
+	if n < 1 {
+		n = 1
+	}
+	p := &Proxy{}
+	for _, a := range addrs {
+		vp, err := venti.NewPool(a, &venti.PoolConfig{Size: n})
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("proxy: %s: %v", a, err)
+		}
+		p.up = append(p.up, &upstream{addr: a, p: vp})
+	}
+	return p, nil
+}
+
+// Handshake is a venti.Handshake that serves every client from p.
+func (p *Proxy) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, p, nil
+}
+
+// Read asks each upstream in turn for the block.
+func (p *Proxy) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	var errs []string
+	var perr error
+	for _, u := range p.up {
+		r, err := u.p.Read(k, s, ct)
+		if err == nil {
+			return r, nil
+		}
+		if perr == nil {
+			perr = err
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", u.addr, err))
+	}
+	// Wrap the primary's error, so errors.Is works.
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("proxy: %s: %w", p.up[0].addr, perr)
+	}
+	return nil, fmt.Errorf("proxy: %s: %w (also: %s)", p.up[0].addr, perr, strings.Join(errs, "; "))
+}
+
+// Has asks each upstream in turn whether it has the block. If none does,
+// and any failed, the first failure is returned.
+func (p *Proxy) Has(s venti.Score, k venti.Type) (bool, error) {
+	var errs []string
+	var ferr error
+	var faddr string
+	for _, u := range p.up {
+		ok, err := u.p.Has(context.Background(), s, k)
+		switch {
+		case err == nil && ok:
+			return true, nil
+		case err == nil:
+		case ferr == nil:
+			ferr, faddr = err, u.addr
+		default:
+			errs = append(errs, fmt.Sprintf("%s: %v", u.addr, err))
+		}
+	}
+	switch {
+	case ferr == nil:
+		return false, nil
+	case len(errs) == 0:
+		return false, fmt.Errorf("proxy: %s: %w", faddr, ferr)
+	}
+	return false, fmt.Errorf("proxy: %s: %w (also: %s)", faddr, ferr, strings.Join(errs, "; "))
+}
+
+// Write forwards the block to the primary upstream.
+func (p *Proxy) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	if p.ReadOnly {
+		return nil, venti.ErrReadOnly
+	}
+	return p.up[0].p.Write(k, r)
+}
+
+// Sync syncs the primary upstream.
+func (p *Proxy) Sync() error {
+	if p.ReadOnly {
+		return nil
+	}
+	return p.up[0].p.Sync()
+}
+
+// Close closes every upstream connection.
+func (p *Proxy) Close() error {
+	var err error
+	for _, u := range p.up {
+		if cerr := u.p.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
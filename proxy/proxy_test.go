@@ -0,0 +1,110 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// serve starts a server for h and returns its address and a cleanup
+// function.
+func serve(t *testing.T, hs venti.Handshake) (string, func()) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go venti.Serve(l, hs)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestHandler(t *testing.T) {
+	a, done := serve(t, ventitest.NewMemFS().Handshake)
+	defer done()
+	p, err := Dial([]string{a}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ventitest.TestHandler(t, p)
+}
+
+func TestFallback(t *testing.T) {
+	old := ventitest.NewMemFS()
+	b := []byte("migrate me")
+	s, err := old.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := ventitest.NewMemFS()
+
+	a1, done := serve(t, primary.Handshake)
+	defer done()
+	a2, done := serve(t, old.Handshake)
+	defer done()
+	p, err := Dial([]string{a1, a2}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Serve the proxy itself, and talk to it like any other server.
+	pa, done := serve(t, p.Handshake)
+	defer done()
+	c, err := venti.Dial(pa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, err := c.Read(venti.VtData, s, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatalf("exp %q, got %q", b, got)
+	}
+
+	// Writes go to the primary.
+	s, err = c.Write(venti.VtData, bytes.NewReader([]byte("new")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.Read(s, venti.VtData, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Read(s, venti.VtData, 3); err == nil {
+		t.Fatal("write went to the wrong upstream")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	a, done := serve(t, ventitest.NewMemFS().Handshake)
+	defer done()
+	p, err := Dial([]string{a}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.ReadOnly = true
+
+	if _, err := p.Write(venti.VtData, bytes.NewReader(nil)); err != venti.ErrReadOnly {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrReconnected is returned by Redialer.Sync when blocks were written on
+// a connection that has since been replaced. The server may have lost
+// them, so they should be written again.
+var ErrReconnected = fmt.Errorf("reconnected since the last sync")
+
+// RetryPolicy says how often a Redialer tries an operation, and how long
+// it waits in between.
+type RetryPolicy struct {
+	// Attempts is the most times an operation is tried. If zero, 5.
+	Attempts int
+	// Wait is the time before the first retry, doubling for each one
+	// after, up to MaxWait. If zero, 100ms and 10s.
+	Wait, MaxWait time.Duration
+}
+
+// RedialConfig is the settings for a Redialer.
+type RedialConfig struct {
+	Retry RetryPolicy
+
+	// Dialer and Client are used for each connection, as in DialContext.
+	Dialer *net.Dialer
+	Client *ClientConfig
+}
+
+// Redialer is a client that redials its server when the connection breaks,
+// and retries the operations that failed with it.
+//
+// Read, Has, Ping, and Write are retried: writes are content-addressed, so
+// doing one twice is harmless. Errors from the server aren't retried. Sync
+// is, unless writes it should cover were lost with a connection; see
+// ErrReconnected.
+type Redialer struct {
+	addr string
+	cfg  RedialConfig
+
+	mu      sync.Mutex
+	c       *Client
+	gen     uint64        // Counts connections.
+	dialing chan struct{} // Closed when the dial in progress, if any, ends.
+	err     error         // The last dial error.
+	closed  bool
+	done    chan struct{}
+
+	// Ctx is canceled by Close, to stop a dial.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Dirty is the connection the oldest unsynced write was on, or 0, and
+	// writes counts every write.
+	dirty  uint64
+	writes uint64
+}
+
+// NewRedialer connects to addr, a dial string as for DialAddr. A nil cfg is
+// the same as the zero RedialConfig.
+func NewRedialer(addr string, cfg *RedialConfig) (*Redialer, error) {
+	r := &Redialer{
+		addr: addr,
+		done: make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if cfg != nil {
+		r.cfg = *cfg
+	}
+	p := &r.cfg.Retry
+	if p.Attempts <= 0 {
+		p.Attempts = 5
+	}
+	if p.Wait <= 0 {
+		p.Wait = 100 * time.Millisecond
+	}
+	if p.MaxWait <= 0 {
+		p.MaxWait = 10 * time.Second
+	}
+	if _, _, err := r.client(); err != nil {
+		r.cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Client returns the current connection, dialing a new one if it's broken.
+// Only one dial runs at a time, outside the lock; anyone else who needs a
+// connection meanwhile waits for it, and gets its error.
+func (r *Redialer) client() (*Client, uint64, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, 0, fmt.Errorf("venti: redialer closed")
+	}
+	if r.c != nil && r.c.Err() == nil {
+		defer r.mu.Unlock()
+		return r.c, r.gen, nil
+	}
+	if w := r.dialing; w != nil {
+		r.mu.Unlock()
+		<-w
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.closed {
+			return nil, 0, fmt.Errorf("venti: redialer closed")
+		}
+		if r.c == nil || r.c.Err() != nil {
+			return nil, 0, r.err
+		}
+		return r.c, r.gen, nil
+	}
+	w := make(chan struct{})
+	r.dialing = w
+	r.mu.Unlock()
+
+	c, err := DialContext(r.ctx, r.cfg.Dialer, r.addr, r.cfg.Client)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialing = nil
+	close(w)
+	if r.closed {
+		if c != nil {
+			c.Close()
+		}
+		return nil, 0, fmt.Errorf("venti: redialer closed")
+	}
+	if err != nil {
+		r.err = err
+		return nil, 0, err
+	}
+	r.c = c
+	r.gen++
+	return r.c, r.gen, nil
+}
+
+// Do runs op until it works, fails for a reason other than the
+// connection, or runs out of attempts.
+func (r *Redialer) do(op func(*Client, uint64) error) error {
+	var err error
+	wait := r.cfg.Retry.Wait
+	for i := 0; i < r.cfg.Retry.Attempts; i++ {
+		if i > 0 {
+			select {
+			case <-r.done:
+				return fmt.Errorf("venti: redialer closed")
+			case <-time.After(wait):
+			}
+			if wait *= 2; wait > r.cfg.Retry.MaxWait {
+				wait = r.cfg.Retry.MaxWait
+			}
+		}
+		c, gen, derr := r.client()
+		if derr != nil {
+			err = derr
+			continue
+		}
+		if err = op(c, gen); err == nil || !broken(c, err) {
+			return err
+		}
+		c.Close()
+	}
+	return err
+}
+
+// Broken reports whether err means c's connection is gone.
+func broken(c *Client, err error) bool {
+	var se *ServerError
+	if errors.As(err, &se) {
+		return false
+	}
+	var ne net.Error
+	return c.Err() != nil || errors.As(err, &ne) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Read reads a block, as Client.Read does.
+func (r *Redialer) Read(t Type, s Score, ct int64) (rc io.ReadCloser, err error) {
+	err = r.do(func(c *Client, _ uint64) error {
+		rc, err = c.Read(t, s, ct)
+		return err
+	})
+	return rc, err
+}
+
+// Write writes a block, as Client.Write does. The block is read from rd
+// before it's sent, so it can be sent again.
+func (r *Redialer) Write(t Type, rd io.Reader) (s Score, err error) {
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	err = r.do(func(c *Client, gen uint64) error {
+		if s, err = c.Write(t, bytes.NewReader(b)); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if r.dirty == 0 {
+			r.dirty = gen
+		}
+		r.writes++
+		r.mu.Unlock()
+		return nil
+	})
+	return s, err
+}
+
+// Has reports whether the server has a block, as Client.Has does.
+func (r *Redialer) Has(ctx context.Context, s Score, t Type) (ok bool, err error) {
+	err = r.do(func(c *Client, _ uint64) error {
+		ok, err = c.Has(ctx, s, t)
+		return err
+	})
+	return ok, err
+}
+
+// Ping pings the server, as Client.Ping does.
+func (r *Redialer) Ping() error {
+	return r.do(func(c *Client, _ uint64) error {
+		return c.Ping()
+	})
+}
+
+// Sync syncs the server. It fails with ErrReconnected if any write since
+// the last Sync was on an earlier connection; the error is only reported
+// once. Otherwise it's retried like the rest.
+func (r *Redialer) Sync() error {
+	return r.do(func(c *Client, gen uint64) error {
+		r.mu.Lock()
+		dirty, writes := r.dirty, r.writes
+		if dirty != 0 && dirty != gen {
+			r.dirty = 0
+			r.mu.Unlock()
+			return ErrReconnected
+		}
+		r.mu.Unlock()
+
+		if err := c.Sync(); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		// Writes that finished while syncing may not be covered.
+		if r.writes == writes {
+			r.dirty = 0
+		}
+		r.mu.Unlock()
+		return nil
+	})
+}
+
+// Handler returns a Handler that forwards every operation to the Redialer.
+func (r *Redialer) Handler() Handler {
+	return redialHandler{r}
+}
+
+type redialHandler struct {
+	r *Redialer
+}
+
+func (h redialHandler) Read(s Score, t Type, ct int64) (io.Reader, error) {
+	return h.r.Read(t, s, ct)
+}
+
+func (h redialHandler) Write(t Type, rd io.Reader) (Score, error) {
+	return h.r.Write(t, rd)
+}
+
+func (h redialHandler) Has(s Score, t Type) (bool, error) {
+	return h.r.Has(context.Background(), s, t)
+}
+
+func (h redialHandler) Sync() error {
+	return h.r.Sync()
+}
+
+// Close closes the connection, and stops any dial. Operations waiting to
+// retry fail.
+func (r *Redialer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	close(r.done)
+	if r.c == nil {
+		return nil
+	}
+	return r.c.Close()
+}
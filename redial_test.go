@@ -0,0 +1,222 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+var fastRetry = venti.RetryPolicy{Attempts: 5, Wait: time.Millisecond, MaxWait: 10 * time.Millisecond}
+
+// Hangup closes every connection the server has, like a restart.
+func hangup(tr *tracker) {
+	tr.each(func(c *stallConn) { c.Close() })
+}
+
+func TestRedial(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	r, err := venti.NewRedialer(l.Addr().String(), &venti.RedialConfig{Retry: fastRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	blk := []byte("redial")
+	s, err := r.Write(venti.VtData, bytes.NewReader(blk))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hangup(tr)
+	rc, err := r.Read(venti.VtData, s, int64(len(blk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(rc); !bytes.Equal(got, blk) {
+		t.Fatalf("exp %q, got %q", blk, got)
+	}
+
+	hangup(tr)
+	if err := r.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	hangup(tr)
+	if _, err := r.Write(venti.VtData, bytes.NewReader(blk)); err != nil {
+		t.Fatal(err)
+	}
+	if n := tr.accepted(); n != 4 {
+		t.Fatalf("exp 4 connections, got %d", n)
+	}
+	if err := r.Sync(); !errors.Is(err, venti.ErrReconnected) {
+		t.Fatalf("exp %v, got %v", venti.ErrReconnected, err)
+	}
+	ventitest.TestHandler(t, r.Handler())
+}
+
+// Writes from before a reconnect can't be vouched for by a Sync after.
+func TestRedialSync(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	r, err := venti.NewRedialer(l.Addr().String(), &venti.RedialConfig{Retry: fastRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Write(venti.VtData, bytes.NewReader([]byte("one"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Synced writes don't matter.
+	hangup(tr)
+	if err := r.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Write(venti.VtData, bytes.NewReader([]byte("two"))); err != nil {
+		t.Fatal(err)
+	}
+	hangup(tr)
+	if err := r.Sync(); !errors.Is(err, venti.ErrReconnected) {
+		t.Fatalf("exp %v, got %v", venti.ErrReconnected, err)
+	}
+	if err := r.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedialServerError(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewErrFS(venti.ErrTooBig).Handshake, tr.wrap)
+	r, err := venti.NewRedialer(l.Addr().String(), &venti.RedialConfig{Retry: fastRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Write(venti.VtData, bytes.NewReader([]byte("big"))); !errors.Is(err, venti.ErrTooBig) {
+		t.Fatalf("exp %v, got %v", venti.ErrTooBig, err)
+	}
+	if n := tr.accepted(); n != 1 {
+		t.Fatalf("server errors were retried: %d connections", n)
+	}
+}
+
+func TestRedialDown(t *testing.T) {
+	tr := &tracker{}
+	l := listen(t, "localhost:0", ventitest.NewMemFS().Handshake, tr.wrap)
+	r, err := venti.NewRedialer(l.Addr().String(), &venti.RedialConfig{Retry: fastRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	l.Close()
+	hangup(tr)
+	if err := r.Ping(); err == nil {
+		t.Fatal("pinged a server that's gone")
+	}
+	r.Close()
+	if err := r.Ping(); err == nil {
+		t.Fatal("pinged on a closed redialer")
+	}
+}
+
+// HangListener stops serving the connections it accepts once hung, like a
+// server that takes connections but never answers.
+type hangListener struct {
+	net.Listener
+	mu    sync.Mutex
+	hung  bool
+	conns []net.Conn
+}
+
+func (l *hangListener) Accept() (net.Conn, error) {
+	for {
+		nc, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		l.conns = append(l.conns, nc)
+		hung := l.hung
+		l.mu.Unlock()
+		if !hung {
+			return nc, nil
+		}
+	}
+}
+
+// Hang stops serving new connections, and closes the old ones.
+func (l *hangListener) hang() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hung = true
+	for _, nc := range l.conns {
+		nc.Close()
+	}
+}
+
+func (l *hangListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, nc := range l.conns {
+		nc.Close()
+	}
+	return l.Listener.Close()
+}
+
+// A dial that never finishes mustn't hold up Close, or other callers past
+// Close.
+func TestRedialCloseDialing(t *testing.T) {
+	nl, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &hangListener{Listener: nl}
+	defer l.Close()
+	go venti.Serve(l, ventitest.NewMemFS().Handshake)
+	r, err := venti.NewRedialer(nl.Addr().String(), &venti.RedialConfig{Retry: fastRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.hang()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- r.Ping() }()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- r.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the dial")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatal("pinged a server that never answered")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Ping waited for the dial after Close")
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package s3fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file is just enough of the S3 REST API for a Store: path-style PUT,
+// GET, and ListObjectsV2, signed with AWS Signature Version 4.
+
+const (
+	sigAlgo     = "AWS4-HMAC-SHA256"
+	amzDate     = "20060102T150405Z"
+	amzDay      = "20060102"
+	hdrDate     = "X-Amz-Date"
+	hdrSHA256   = "X-Amz-Content-Sha256"
+	hdrMetaType = "X-Amz-Meta-Venti-Type"
+)
+
+// errNotFound is returned by get for a 404.
+var errNotFound = fmt.Errorf("s3: not found")
+
+type bucket struct {
+	endpoint *url.URL
+	name     string
+	region   string
+	key      string
+	secret   string
+	c        *http.Client
+	now      func() time.Time
+}
+
+func (b *bucket) url(key string, q url.Values) *url.URL {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.name
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = strings.Replace(q.Encode(), "+", "%20", -1)
+	return &u
+}
+
+func (b *bucket) do(method, key string, q url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.url(key, q).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	sign(req, body, b.key, b.secret, b.region, b.now())
+	res, err := b.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, errNotFound
+	case res.StatusCode/100 != 2:
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, res.Status, bytes.TrimSpace(msg))
+	}
+	return res, nil
+}
+
+func (b *bucket) put(key string, body []byte, hdr http.Header) error {
+	res, err := b.do("PUT", key, nil, hdr, body)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Get fetches the object, or the byte range [off, off+n) of it if n is
+// positive.
+func (b *bucket) get(key string, off, n int64) ([]byte, http.Header, error) {
+	hdr := http.Header{}
+	if n > 0 {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	}
+	res, err := b.do("GET", key, nil, hdr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	d, err := ioutil.ReadAll(res.Body)
+	return d, res.Header, err
+}
+
+type listResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the keys of every object starting with prefix.
+func (b *bucket) list(prefix string) ([]string, error) {
+	var keys []string
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		res, err := b.do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		lr := listResult{}
+		err = xml.NewDecoder(res.Body).Decode(&lr)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: list: %v", err)
+		}
+		for _, c := range lr.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !lr.IsTruncated {
+			return keys, nil
+		}
+		q.Set("continuation-token", lr.NextContinuationToken)
+	}
+}
+
+// Sign adds the Signature Version 4 headers to req.
+func sign(req *http.Request, body []byte, key, secret, region string, t time.Time) {
+	t = t.UTC()
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	req.Header.Set(hdrDate, t.Format(amzDate))
+	req.Header.Set(hdrSHA256, payload)
+
+	scope := strings.Join([]string{t.Format(amzDay), region, "s3", "aws4_request"}, "/")
+	signed, creq := canonical(req, payload)
+	sum = sha256.Sum256([]byte(creq))
+	sts := strings.Join([]string{sigAlgo, t.Format(amzDate), scope, hex.EncodeToString(sum[:])}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+secret), t.Format(amzDay))
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, sts))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgo, key, scope, signed, sig))
+}
+
+// Canonical returns the signed header list and the canonical request.
+func canonical(req *http.Request, payload string) (string, string) {
+	hdrs := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			hdrs[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	ch := &bytes.Buffer{}
+	for _, k := range names {
+		fmt.Fprintf(ch, "%s:%s\n", k, hdrs[k])
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	signed := strings.Join(names, ";")
+	creq := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		ch.String(),
+		signed,
+		payload,
+	}, "\n")
+	return signed, creq
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
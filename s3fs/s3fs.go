@@ -0,0 +1,366 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package s3fs is a venti.Handler that stores blocks in an S3-compatible bucket.
+
+Sending each small block as its own object is slow and, on most providers,
+expensive, so blocks are collected into pack objects. A pack is uploaded once
+it reaches Config.PackSize, or on Sync. Next to each pack is an index object
+that lists the blocks in it, one per line:
+
+	score type offset size
+
+Blocks of at least Config.PackSize are stored as their own object, named by
+the score's hex and the type, with the type in the "venti-type" metadata too. Each has an
+index object too, listing just it, so they're found the same way.
+
+When a Store is opened, the indexes are read to find every uploaded block.
+Until its upload finishes, a block is served out of memory. Sync returns once
+every upload started before it has finished.
+*/
+package s3fs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hdonnay/venti"
+)
+
+const defaultPackSize = 8 << 20
+
+// Config describes the bucket a Store uses.
+type Config struct {
+	// Endpoint is the base URL of the S3 service. Buckets are addressed
+	// path-style, as Endpoint/Bucket/key.
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	AccessKey, SecretKey string
+
+	// Prefix is prepended to every object name.
+	Prefix string
+	// PackSize is the size a pack object is uploaded at. If zero, 8MiB is
+	// used.
+	PackSize int
+	// Client is used for requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Store is the S3-backed Handler.
+type Store struct {
+	b        *bucket
+	prefix   string
+	packSize int
+
+	mu *sync.Mutex
+	// index is every uploaded block, and mem every block that isn't
+	// uploaded yet, by key. Types maps a score to one of the types it's
+	// stored as.
+	index map[string]loc
+	mem   map[string]block
+	types map[string]venti.Type
+	// pack is the pack being filled.
+	pack *upload
+	// running and failed are uploads in progress and uploads that need to be
+	// retried. done is signalled when an upload finishes.
+	running int
+	failed  []*upload
+	err     error
+	done    *sync.Cond
+}
+
+type loc struct {
+	key  string
+	kind venti.Type
+	off  int64
+	size int64
+}
+
+type block struct {
+	kind venti.Type
+	data []byte
+}
+
+// Upload is either a pack and its index, or a single large block.
+type upload struct {
+	key    string
+	data   *bytes.Buffer
+	kind   venti.Type // for single blocks
+	packed []string   // keys in a pack, in order
+	idx    []loc
+}
+
+// Open returns a Store for the bucket described by cfg, reading the indexes of
+// any packs already in it.
+func Open(cfg Config) (*Store, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3fs: bad endpoint: %v", err)
+	}
+	c := cfg.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	s := &Store{
+		b: &bucket{
+			endpoint: u,
+			name:     cfg.Bucket,
+			region:   cfg.Region,
+			key:      cfg.AccessKey,
+			secret:   cfg.SecretKey,
+			c:        c,
+			now:      time.Now,
+		},
+		prefix:   cfg.Prefix,
+		packSize: cfg.PackSize,
+		mu:       &sync.Mutex{},
+		index:    make(map[string]loc),
+		mem:      make(map[string]block),
+		types:    make(map[string]venti.Type),
+	}
+	if s.packSize <= 0 {
+		s.packSize = defaultPackSize
+	}
+	s.done = sync.NewCond(s.mu)
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) packKey(name string) string { return s.prefix + "packs/" + name }
+
+// BlockKey is the name of a big block's object.
+func (s *Store) blockKey(sc venti.Score, k venti.Type) string {
+	return s.prefix + "blocks/" + hex.EncodeToString(sc) + "." + strconv.Itoa(int(k))
+}
+
+// Key is what a block is indexed by: its score, then its type.
+func key(sc venti.Score, k venti.Type) string {
+	return string(sc) + string([]byte{byte(k)})
+}
+
+// Load reads every index in the bucket.
+func (s *Store) load() error {
+	var keys []string
+	for _, p := range []string{s.packKey(""), s.prefix + "blocks/"} {
+		ks, err := s.b.list(p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, ks...)
+	}
+	for _, k := range keys {
+		if !strings.HasSuffix(k, ".idx") {
+			continue
+		}
+		d, _, err := s.b.get(k, 0, 0)
+		if err != nil {
+			return err
+		}
+		if err := s.loadIndex(strings.TrimSuffix(k, ".idx"), d); err != nil {
+			return fmt.Errorf("s3fs: %s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadIndex(pack string, d []byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(d))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) != 4 {
+			return fmt.Errorf("bad line %q", sc.Text())
+		}
+		score, err := hex.DecodeString(f[0])
+		if err != nil {
+			return err
+		}
+		var n [3]int64
+		for i := range n {
+			if n[i], err = strconv.ParseInt(f[i+1], 10, 64); err != nil {
+				return err
+			}
+		}
+		k := venti.Type(n[0])
+		s.index[key(score, k)] = loc{key: pack, kind: k, off: n[1], size: n[2]}
+		s.types[string(score)] = k
+	}
+	return sc.Err()
+}
+
+// Handshake is a venti.Handshake that serves every client from s.
+func (s *Store) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, s, nil
+}
+
+// Read returns the block out of memory, a ranged read of its pack, or its own
+// object.
+func (s *Store) Read(sc venti.Score, k venti.Type, _ int64) (io.Reader, error) {
+	s.mu.Lock()
+	b, inMem := s.mem[key(sc, k)]
+	l, packed := s.index[key(sc, k)]
+	t, other := s.types[string(sc)]
+	s.mu.Unlock()
+
+	switch {
+	case inMem:
+		return bytes.NewReader(b.data), nil
+	case packed && l.size == 0:
+		return bytes.NewReader(nil), nil
+	case packed:
+		d, _, err := s.b.get(l.key, l.off, l.size)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(d)) != l.size {
+			return nil, fmt.Errorf("s3fs: %s: short read for %v", l.key, sc)
+		}
+		return bytes.NewReader(d), nil
+	case other:
+		return nil, venti.CheckType(sc, t, k)
+	}
+	return nil, venti.NotFound(sc, k)
+}
+
+// Has reports whether the block is stored.
+func (s *Store) Has(sc venti.Score, k venti.Type) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, inMem := s.mem[key(sc, k)]
+	_, packed := s.index[key(sc, k)]
+	return inMem || packed, nil
+}
+
+// Write keeps the block in memory and adds it to the current pack, or starts
+// uploading it if it's big.
+func (s *Store) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	buf := &bytes.Buffer{}
+	h := sha1.New()
+	if _, err := io.Copy(buf, io.TeeReader(r, h)); err != nil {
+		return nil, err
+	}
+	sc := venti.Score(h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mem[key(sc, k)]; ok {
+		return sc, nil
+	}
+	if _, ok := s.index[key(sc, k)]; ok {
+		return sc, nil
+	}
+	s.mem[key(sc, k)] = block{kind: k, data: buf.Bytes()}
+	s.types[string(sc)] = k
+
+	if buf.Len() >= s.packSize {
+		s.start(&upload{key: s.blockKey(sc, k), data: buf, kind: k, packed: []string{key(sc, k)}})
+		return sc, nil
+	}
+	if s.pack == nil {
+		s.pack = &upload{data: &bytes.Buffer{}}
+	}
+	s.pack.idx = append(s.pack.idx, loc{kind: k, off: int64(s.pack.data.Len()), size: int64(buf.Len())})
+	s.pack.packed = append(s.pack.packed, key(sc, k))
+	s.pack.data.Write(buf.Bytes())
+	if s.pack.data.Len() >= s.packSize {
+		s.seal()
+	}
+	return sc, nil
+}
+
+// Seal names the current pack and starts uploading it. The caller must hold
+// the lock.
+func (s *Store) seal() {
+	if s.pack == nil {
+		return
+	}
+	sum := sha1.Sum(s.pack.data.Bytes())
+	s.pack.key = s.packKey(hex.EncodeToString(sum[:]))
+	s.start(s.pack)
+	s.pack = nil
+}
+
+// Start uploads u in the background. The caller must hold the lock.
+func (s *Store) start(u *upload) {
+	s.running++
+	go func() {
+		err := s.put(u)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running--
+		if err != nil {
+			s.err = err
+			s.failed = append(s.failed, u)
+		} else {
+			for i, k := range u.packed {
+				l := loc{kind: u.kind, size: int64(u.data.Len())}
+				if u.idx != nil {
+					l = u.idx[i]
+				}
+				l.key = u.key
+				s.index[k] = l
+				delete(s.mem, k)
+			}
+		}
+		s.done.Broadcast()
+	}()
+}
+
+func (s *Store) put(u *upload) error {
+	idx := &bytes.Buffer{}
+	if u.idx == nil {
+		hdr := http.Header{}
+		hdr.Set(hdrMetaType, strconv.Itoa(int(u.kind)))
+		if err := s.b.put(u.key, u.data.Bytes(), hdr); err != nil {
+			return err
+		}
+		fmt.Fprintf(idx, "%x %d %d %d\n", score(u.packed[0]), u.kind, 0, u.data.Len())
+		return s.b.put(u.key+".idx", idx.Bytes(), nil)
+	}
+	if err := s.b.put(u.key, u.data.Bytes(), nil); err != nil {
+		return err
+	}
+	// The index goes second, so a pack is never listed before it exists.
+	for i, k := range u.packed {
+		l := u.idx[i]
+		fmt.Fprintf(idx, "%x %d %d %d\n", score(k), l.kind, l.off, l.size)
+	}
+	return s.b.put(u.key+".idx", idx.Bytes(), nil)
+}
+
+// Score returns the score part of a key.
+func score(k string) string { return k[:len(k)-1] }
+
+// Sync uploads the current pack, retries any failed uploads, and waits for
+// every upload to finish.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seal()
+	for _, u := range s.failed {
+		s.start(u)
+	}
+	s.failed = nil
+	s.err = nil
+	for s.running > 0 {
+		s.done.Wait()
+	}
+	err := s.err
+	s.err = nil
+	return err
+}
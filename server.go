@@ -5,14 +5,50 @@
 package venti
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 )
 
+// A Server serves venti connections. The zero value, with a Handshake set,
+// is a plain server.
+type Server struct {
+	// Handshake is called with each client's hello.
+	Handshake Handshake
+
+	// Auth authenticates clients that ask for it in their hello. If nil,
+	// those clients are refused. Clients that don't ask are let through
+	// with an unverified UID; the Handshake can check Thello.AuthMethod
+	// to refuse them.
+	Auth Authenticator
+
+	// TLSConfig is used by ServeTLS and ListenAndServeTLS.
+	TLSConfig *tls.Config
+
+	// NoCompression turns down every codec clients offer.
+	NoCompression bool
+
+	// RequireCrypto refuses clients whose sessions wouldn't be encrypted:
+	// those that don't authenticate with a key, or offer no scheme the
+	// server supports.
+	RequireCrypto bool
+}
+
 // Serve accepts connections on l and runs the supplied Handshake function and,
 // if successful, the returned Handler.
 func Serve(l net.Listener, h Handshake) error {
-	if h == nil {
+	return (&Server{Handshake: h}).Serve(l)
+}
+
+// ListenAndServe listens on addr, as for Listen, and calls Serve on the
+// resulting net.Listener.
+func ListenAndServe(addr string, h Handshake) error {
+	return (&Server{Handshake: h}).ListenAndServe(addr)
+}
+
+// Serve accepts connections on l and serves each in its own goroutine.
+func (s *Server) Serve(l net.Listener) error {
+	if s.Handshake == nil {
 		return fmt.Errorf("venti: bad handshake function")
 	}
 	for {
@@ -20,16 +56,26 @@ func Serve(l net.Listener, h Handshake) error {
 		if err != nil {
 			return err
 		}
-		go accept(conn, h)
+		go accept(conn, s)
+	}
+}
+
+// ServeConn serves the single connection nc, which needn't be from a
+// net.Listener; a net.Pipe works. It returns when the connection closes.
+func (s *Server) ServeConn(nc net.Conn) error {
+	if s.Handshake == nil {
+		return fmt.Errorf("venti: bad handshake function")
 	}
+	accept(nc, s)
+	return nil
 }
 
-// ListenAndServe listens on the TCP address "addr" and calls Serve on the
+// ListenAndServe listens on addr, as for Listen, and calls Serve on the
 // resulting net.Listener.
-func ListenAndServe(addr string, h Handshake) error {
-	l, err := net.Listen("tcp", addr)
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := Listen(addr)
 	if err != nil {
 		return err
 	}
-	return Serve(l, h)
+	return s.Serve(l)
 }
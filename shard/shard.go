@@ -0,0 +1,325 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package shard is a venti.Handler that spreads blocks across several backends
+with consistent hashing.
+
+Each backend gets a number of points on a hash ring proportional to its
+weight, and a block belongs to the backend owning the first point at or after
+its score. Adding a backend moves only the blocks that now hash to it; Rebalance
+copies them over. Until that's done, a read that misses on the block's owner
+probes every other backend.
+*/
+package shard
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hdonnay/venti"
+)
+
+// Walker is implemented by backends that can list the blocks they hold.
+// Rebalance can only move blocks out of a Walker.
+//
+// Walk should call fn for every block, with its score, type, and size, and
+// stop at the first error.
+type Walker interface {
+	Walk(fn func(venti.Score, venti.Type, int64) error) error
+}
+
+// Shard is the sharding Handler.
+type Shard struct {
+	vnodes int
+
+	mu      *sync.RWMutex
+	backend []*backend
+	ring    []point
+	// migrating is set while blocks may be on the wrong backend.
+	migrating bool
+}
+
+type backend struct {
+	name   string
+	h      venti.Handler
+	weight int
+}
+
+type point struct {
+	hash uint32
+	b    int
+}
+
+// New returns an empty Shard that gives each backend vnodes points on the
+// ring per unit of weight.
+func New(vnodes int) *Shard {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &Shard{
+		vnodes: vnodes,
+		mu:     &sync.RWMutex{},
+	}
+}
+
+// Handshake is a venti.Handshake that serves every client from s.
+func (s *Shard) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, s, nil
+}
+
+// Add puts the backend h on the ring under name. Names must be unique, as
+// they decide where the backend's points go.
+//
+// Adding a backend to a Shard that already has some means existing blocks
+// may now be in the wrong place. Reads fall back to probing every backend
+// until Rebalance succeeds.
+func (s *Shard) Add(name string, h venti.Handler, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("shard: %s: bad weight %d", name, weight)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.backend {
+		if b.name == name {
+			return fmt.Errorf("shard: %s: already added", name)
+		}
+	}
+	if len(s.backend) != 0 {
+		s.migrating = true
+	}
+	s.backend = append(s.backend, &backend{name: name, h: h, weight: weight})
+	i := len(s.backend) - 1
+	for v := 0; v < s.vnodes*weight; v++ {
+		sum := sha1.Sum([]byte(name + "#" + strconv.Itoa(v)))
+		s.ring = append(s.ring, point{hash: binary.BigEndian.Uint32(sum[:4]), b: i})
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return nil
+}
+
+// Owner returns the index of the backend responsible for the block. The
+// caller must hold the lock.
+func (s *Shard) owner(sc venti.Score) int {
+	var k uint32
+	if len(sc) >= 4 {
+		k = binary.BigEndian.Uint32(sc[:4])
+	}
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= k })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].b
+}
+
+// Owner returns the name of the backend responsible for the block with score
+// sc.
+func (s *Shard) Owner(sc venti.Score) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.ring) == 0 {
+		return ""
+	}
+	return s.backend[s.owner(sc)].name
+}
+
+// Lookup returns the backends that may have the block: its owner, and
+// while migrating, every other one.
+func (s *Shard) lookup(sc venti.Score) ([]*backend, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.ring) == 0 {
+		return nil, fmt.Errorf("shard: no backends")
+	}
+	o := s.owner(sc)
+	try := []*backend{s.backend[o]}
+	if s.migrating {
+		for i, b := range s.backend {
+			if i != o {
+				try = append(try, b)
+			}
+		}
+	}
+	return try, nil
+}
+
+// Read asks the block's owner, and while migrating, every other backend.
+func (s *Shard) Read(sc venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	try, err := s.lookup(sc)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	var oerr error
+	for _, b := range try {
+		r, err := b.h.Read(sc, k, ct)
+		if err == nil {
+			return r, nil
+		}
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if oerr == nil {
+			oerr = err
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", b.name, err))
+	}
+	// The owner's answer is the one that counts; wrap it so errors.Is works.
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("shard: %s: %w", try[0].name, oerr)
+	}
+	return nil, fmt.Errorf("shard: %s: %w (also: %s)", try[0].name, oerr, strings.Join(errs, "; "))
+}
+
+// Has asks the same backends as Read. If none has the block, and any
+// failed, the first failure is returned.
+func (s *Shard) Has(sc venti.Score, k venti.Type) (bool, error) {
+	try, err := s.lookup(sc)
+	if err != nil {
+		return false, err
+	}
+
+	var errs []string
+	var ferr error
+	var fname string
+	for _, b := range try {
+		ok, err := venti.Has(b.h, sc, k)
+		switch {
+		case err == nil && ok:
+			return true, nil
+		case err == nil:
+		case ferr == nil:
+			ferr, fname = err, b.name
+		default:
+			errs = append(errs, fmt.Sprintf("%s: %v", b.name, err))
+		}
+	}
+	switch {
+	case ferr == nil:
+		return false, nil
+	case len(errs) == 0:
+		return false, fmt.Errorf("shard: %s: %w", fname, ferr)
+	}
+	return false, fmt.Errorf("shard: %s: %w (also: %s)", fname, ferr, strings.Join(errs, "; "))
+}
+
+// Write sends the block to its owner. The score isn't known until the block
+// has been read, so the block is buffered first.
+func (s *Shard) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	buf := &bytes.Buffer{}
+	h := sha1.New()
+	if _, err := io.Copy(buf, io.TeeReader(r, h)); err != nil {
+		return nil, err
+	}
+	sc := venti.Score(h.Sum(nil))
+
+	s.mu.RLock()
+	if len(s.ring) == 0 {
+		s.mu.RUnlock()
+		return nil, fmt.Errorf("shard: no backends")
+	}
+	b := s.backend[s.owner(sc)]
+	s.mu.RUnlock()
+
+	got, err := b.h.Write(k, buf)
+	if err != nil {
+		return nil, fmt.Errorf("shard: %s: %w", b.name, err)
+	}
+	if !bytes.Equal(got, sc) {
+		return nil, fmt.Errorf("shard: %s: returned score %v for %v", b.name, got, sc)
+	}
+	return sc, nil
+}
+
+// Sync syncs every backend.
+func (s *Shard) Sync() error {
+	s.mu.RLock()
+	bs := append([]*backend(nil), s.backend...)
+	s.mu.RUnlock()
+	for _, b := range bs {
+		if err := b.h.Sync(); err != nil {
+			return fmt.Errorf("shard: %s: %w", b.name, err)
+		}
+	}
+	return nil
+}
+
+// Rebalance walks every backend and copies each block that belongs somewhere
+// else to its owner, returning the number of blocks copied. Blocks aren't
+// removed from where they were; a Handler has no way to do that.
+//
+// Rebalance is meant to run in the background after an Add. Reads and writes
+// continue as normal while it runs. If every backend was walked without
+// error, reads stop probing for misplaced blocks. Backends that aren't
+// Walkers can't be rebalanced, and are reported in the returned error.
+func (s *Shard) Rebalance() (int, error) {
+	s.mu.RLock()
+	bs := append([]*backend(nil), s.backend...)
+	s.mu.RUnlock()
+
+	n := 0
+	var skip []string
+	for i, b := range bs {
+		w, ok := b.h.(Walker)
+		if !ok {
+			skip = append(skip, b.name)
+			continue
+		}
+		err := w.Walk(func(sc venti.Score, k venti.Type, sz int64) error {
+			s.mu.RLock()
+			o := s.owner(sc)
+			dst := s.backend[o]
+			s.mu.RUnlock()
+			if o == i {
+				return nil
+			}
+			if err := move(b, dst, sc, k, sz); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return n, fmt.Errorf("shard: rebalancing %s: %w", b.name, err)
+		}
+	}
+	if len(skip) != 0 {
+		return n, fmt.Errorf("shard: can't walk %s", strings.Join(skip, ", "))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Something may have been added while we were walking.
+	if len(s.backend) == len(bs) {
+		s.migrating = false
+	}
+	return n, nil
+}
+
+func move(src, dst *backend, sc venti.Score, k venti.Type, sz int64) error {
+	r, err := src.h.Read(sc, k, sz)
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", sc, err)
+	}
+	got, err := dst.h.Write(k, r)
+	if err != nil {
+		return fmt.Errorf("writing %v to %s: %w", sc, dst.name, err)
+	}
+	if !bytes.Equal(got, sc) {
+		return fmt.Errorf("%s returned score %v for %v", dst.name, got, sc)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package shard
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func TestHandler(t *testing.T) {
+	s := New(16)
+	for i := 0; i < 3; i++ {
+		if err := s.Add(fmt.Sprint("mem", i), ventitest.NewMemFS(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ventitest.TestHandler(t, s)
+}
+
+// Errors from the backends can be matched with errors.Is.
+func TestErrorsIs(t *testing.T) {
+	s := New(16)
+	s.Add("ro", ventitest.NewErrFS(venti.ErrReadOnly), 1)
+	if _, err := s.Write(venti.VtData, bytes.NewReader([]byte("is"))); !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+	if err := s.Sync(); !errors.Is(err, venti.ErrReadOnly) {
+		t.Fatalf("exp %v, got %v", venti.ErrReadOnly, err)
+	}
+
+	s = New(16)
+	s.Add("mem", ventitest.NewMemFS(), 1)
+	sc := sha1.Sum([]byte("missing"))
+	if _, err := s.Read(sc[:], venti.VtData, 7); !errors.Is(err, venti.ErrNotFound) {
+		t.Fatalf("exp %v, got %v", venti.ErrNotFound, err)
+	}
+}
+
+func TestWeight(t *testing.T) {
+	s := New(64)
+	s.Add("small", ventitest.NewMemFS(), 1)
+	s.Add("big", ventitest.NewMemFS(), 3)
+
+	ct := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		sc := sha1.Sum([]byte(fmt.Sprint(i)))
+		ct[s.Owner(sc[:])]++
+	}
+	// Big should get about three quarters of the blocks.
+	if f := float64(ct["big"]) / 4000; f < 0.6 || f > 0.9 {
+		t.Fatalf("unbalanced: %v", ct)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	s := New(16)
+	a, b := ventitest.NewMemFS(), ventitest.NewMemFS()
+	s.Add("a", a, 1)
+
+	data := map[string][]byte{}
+	for i := 0; i < 100; i++ {
+		d := []byte(fmt.Sprint("block ", i))
+		sc, err := s.Write(venti.VtData, bytes.NewReader(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[string(sc)] = d
+	}
+
+	if err := s.Add("b", b, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Everything's still on a, so reads have to probe.
+	for sc, d := range data {
+		r, err := s.Read(venti.Score(sc), venti.VtData, int64(len(d)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadAll(r); !bytes.Equal(d, got) {
+			t.Fatalf("exp %q, got %q", d, got)
+		}
+	}
+
+	n, err := s.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n == len(data) {
+		t.Fatalf("moved %d of %d blocks", n, len(data))
+	}
+	if s.migrating {
+		t.Fatal("still migrating after Rebalance")
+	}
+	a.Reset() // only blocks owned by a need to be found now
+	for sc, d := range data {
+		r, err := s.Read(venti.Score(sc), venti.VtData, int64(len(d)))
+		if s.Owner(venti.Score(sc)) == "a" {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadAll(r); !bytes.Equal(d, got) {
+			t.Fatalf("exp %q, got %q", d, got)
+		}
+	}
+}
+
+func TestRemote(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go venti.Serve(l, ventitest.NewMemFS().Handshake)
+	c, err := venti.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := New(16)
+	s.Add("local", ventitest.NewMemFS(), 1)
+	s.Add("remote", c.Handler(), 1)
+	ventitest.TestHandler(t, s)
+
+	// The remote backend can't be walked, so it's reported.
+	if _, err := s.Rebalance(); err == nil {
+		t.Fatal("wanted an error, didn't get one")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/internal/msg"
+	"github.com/hdonnay/venti/internal/pack"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// Replies to concurrent requests come back interleaved; each reader has to
+// get its own block however it reads it.
+func TestStreamInterleaved(t *testing.T) {
+	c, done := startServer(t, ventitest.NewMemFS().Handshake)
+	defer done()
+
+	var blks [][]byte
+	var scores []venti.Score
+	for i := 0; i < 16; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, 1<<(i%5)*3000+i)
+		s, err := c.Write(venti.VtData, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks, scores = append(blks, b), append(scores, s)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(blks)*4)
+	for n := 0; n < 4; n++ {
+		for i := range blks {
+			wg.Add(1)
+			go func(i, step int) {
+				defer wg.Done()
+				rc, err := c.Read(venti.VtData, scores[i], int64(len(blks[i])))
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer rc.Close()
+				got := &bytes.Buffer{}
+				b := make([]byte, step)
+				if _, err := io.CopyBuffer(got, struct{ io.Reader }{rc}, b); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got.Bytes(), blks[i]) {
+					errs <- fmt.Errorf("block %d: got %d bytes, wanted %d", i, got.Len(), len(blks[i]))
+				}
+			}(i, 1+n*1000)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Nothing else is read off the connection while a block is being read.
+func TestStreamBackpressure(t *testing.T) {
+	c, done := startServer(t, ventitest.NewMemFS().Handshake)
+	defer done()
+
+	b := bytes.Repeat([]byte("slow"), 10000)
+	s, err := c.Write(venti.VtData, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := c.Read(venti.VtData, s, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rc, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	pinged := make(chan error)
+	go func() { pinged <- c.Ping() }()
+	select {
+	case err := <-pinged:
+		t.Fatalf("ping finished while a read was open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Closing discards the rest, and lets the ping's reply through.
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-pinged; err != nil {
+		t.Fatal(err)
+	}
+	ventitest.TestHandler(t, c.Handler())
+}
+
+// GateFS tells the test when a write starts, and how much it's been given.
+type gateFS struct {
+	*ventitest.MemFS
+	first chan []byte
+}
+
+func (g *gateFS) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, g, nil
+}
+
+func (g *gateFS) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	b := make([]byte, 10)
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	g.first <- b[:n]
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return g.MemFS.Write(k, bytes.NewReader(append(b, rest...)))
+}
+
+// The server hands the Handler a write as it arrives, not once it's all
+// there.
+func TestStreamWrite(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	g := &gateFS{ventitest.NewMemFS(), make(chan []byte, 1)}
+	go (&venti.Server{Handshake: g.Handshake}).ServeConn(sc)
+
+	// Say hello by hand, so the write can be sent in pieces.
+	br := bufio.NewReader(cc)
+	fmt.Fprintf(cc, "venti-04-test\n")
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	w, r := pack.Chunk(cc), pack.Dechunk(br)
+	hw := w.New()
+	io.Copy(hw, &msg.Thello{Version: "04", UID: "test"})
+	if err := hw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+
+	blk := bytes.Repeat([]byte("0123456789"), 100)
+	hdr := make([]byte, 10)
+	binary.BigEndian.PutUint32(hdr, uint32(6+len(blk)))
+	copy(hdr[4:], []byte{msg.KindTwrite, 7, byte(venti.VtData), 0, 0, 0})
+	if _, err := cc.Write(append(hdr, blk[:10]...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-g.first; !bytes.Equal(got, blk[:10]) {
+		t.Fatalf("exp %q, got %q", blk[:10], got)
+	}
+	if _, err := cc.Write(blk[10:]); err != nil {
+		t.Fatal(err)
+	}
+
+	rw, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rw) != 22 || rw[0] != msg.KindRwrite || rw[1] != 7 {
+		t.Fatalf("bad Rwrite: %x", rw)
+	}
+}
+
+// A Handler that doesn't read all of a write mustn't throw off the
+// connection.
+func TestStreamUnreadWrite(t *testing.T) {
+	c, done := startServer(t, ventitest.NewErrFS(venti.ErrTooBig).Handshake)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Write(venti.VtData, bytes.NewReader(make([]byte, 50000)))
+		if err == nil {
+			t.Fatal("write succeeded")
+		}
+		if err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
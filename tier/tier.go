@@ -0,0 +1,376 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+/*
+Package tier is a venti.Handler that stacks a fast store in front of a slow
+one.
+
+New blocks are written to the fast tier and acknowledged right away. A
+background copier then reads them back out of the fast tier and writes them to
+the slow tier, which may be a remote server (see venti.Client.Handler). Reads
+try the fast tier first.
+
+What Sync waits for is controlled by the Policy. Copies that fail are retried
+by the copier, waiting longer after each failure, whatever the Policy.
+
+The copier's queue is only kept in memory. With SyncFast, blocks not yet
+copied when the process stops are left in the fast tier alone; Rescan, after
+a restart, queues them again.
+*/
+package tier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hdonnay/venti"
+)
+
+// Policy controls what a Tier's Sync waits for.
+type Policy int
+
+// These are the Policy constants.
+const (
+	// SyncFast returns once the fast tier is synced. Copies to the slow tier
+	// continue in the background.
+	SyncFast Policy = iota
+	// SyncBoth returns once every block written before the call has been
+	// copied to the slow tier and both tiers are synced.
+	SyncBoth
+)
+
+// The copier waits retryMin after a block's first failed copy, and twice as
+// long after each one after that, up to retryMax.
+var (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// Tier is the composite Handler.
+type Tier struct {
+	fast, slow venti.Handler
+	policy     Policy
+
+	mu   *sync.Mutex
+	cond *sync.Cond
+	// seq numbers the blocks as they're queued.
+	seq uint64
+	// queue is the blocks waiting to be copied, and failed the ones whose
+	// copy didn't work. Both are kept in seq order.
+	queue, failed []*pending
+	// cur is the block the copier has in flight, if any.
+	cur    *pending
+	err    error
+	closed bool
+	done   chan struct{}
+}
+
+type pending struct {
+	seq   uint64
+	score venti.Score
+	kind  venti.Type
+	size  int64
+
+	// For failed copies: the error, how many times it's failed, and when to
+	// try again.
+	err   error
+	tries int
+	retry time.Time
+}
+
+// New returns a Tier and starts its copier. Close stops it.
+func New(fast, slow venti.Handler, p Policy) *Tier {
+	t := &Tier{
+		fast:   fast,
+		slow:   slow,
+		policy: p,
+		mu:     &sync.Mutex{},
+		done:   make(chan struct{}),
+	}
+	t.cond = sync.NewCond(t.mu)
+	go t.copier()
+	return t
+}
+
+// Handshake is a venti.Handshake that serves every client from t.
+func (t *Tier) Handshake(_ *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+	return nil, t, nil
+}
+
+// Pending reports the number of blocks not yet copied to the slow tier.
+func (t *Tier) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.queue) + len(t.failed)
+	if t.cur != nil {
+		n++
+	}
+	return n
+}
+
+// Read tries the fast tier, then the slow tier.
+func (t *Tier) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
+	r, err := t.fast.Read(s, k, ct)
+	if err == nil {
+		return r, nil
+	}
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	r, serr := t.slow.Read(s, k, ct)
+	// The slow tier may have the block as this type even if the fast tier
+	// only has it as another, but if it doesn't have it at all, the
+	// mismatch says more.
+	if errors.Is(err, venti.ErrTypeMismatch) && errors.Is(serr, venti.ErrNotFound) {
+		return nil, err
+	}
+	return r, serr
+}
+
+// Has asks the fast tier, then the slow tier.
+func (t *Tier) Has(s venti.Score, k venti.Type) (bool, error) {
+	if ok, err := venti.Has(t.fast, s, k); err == nil && ok {
+		return true, nil
+	}
+	return venti.Has(t.slow, s, k)
+}
+
+// Write writes the block to the fast tier and queues it to be copied.
+func (t *Tier) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	cr := &counter{r: r}
+	s, err := t.fast.Write(k, cr)
+	if err != nil {
+		return s, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("tier: closed")
+	}
+	t.enqueue(&pending{score: s, kind: k, size: cr.n})
+	t.cond.Broadcast()
+	return s, nil
+}
+
+// Walker is a Handler that can list its blocks, as dirfs.FS, kvfs.Store,
+// and ventitest.MemFS can.
+type Walker interface {
+	Walk(fn func(venti.Score, venti.Type, int64) error) error
+}
+
+// Rescan queues every block in the fast tier for copying, except those the
+// slow tier says it has, if it's a venti.Haser. It returns how many were
+// queued. The fast tier must be a Walker.
+//
+// Copying a block the slow tier already has is harmless, so Rescan can be
+// run whenever copies may have been lost, such as after a restart.
+func (t *Tier) Rescan() (int, error) {
+	w, ok := t.fast.(Walker)
+	if !ok {
+		return 0, fmt.Errorf("tier: fast tier can't list its blocks")
+	}
+	h, _ := t.slow.(venti.Haser)
+	var ps []*pending
+	err := w.Walk(func(s venti.Score, k venti.Type, sz int64) error {
+		if h != nil {
+			ok, err := h.Has(s, k)
+			if err != nil {
+				return fmt.Errorf("tier: checking %v: %w", s, err)
+			}
+			if ok {
+				return nil
+			}
+		}
+		ps = append(ps, &pending{score: append(venti.Score(nil), s...), kind: k, size: sz})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, fmt.Errorf("tier: closed")
+	}
+	for _, p := range ps {
+		t.enqueue(p)
+	}
+	t.cond.Broadcast()
+	return len(ps), nil
+}
+
+// Sync syncs the fast tier and then, depending on the Policy, waits for the
+// copier to catch up and syncs the slow tier.
+//
+// With SyncBoth, blocks whose copy failed are tried again straight away, and
+// Sync waits until the copier has been through every block queued before the
+// call; blocks queued after it aren't waited for. If any of those copies
+// failed, the error is returned. The copier keeps retrying them.
+func (t *Tier) Sync() error {
+	if err := t.fast.Sync(); err != nil {
+		return err
+	}
+	if t.policy == SyncFast {
+		return nil
+	}
+
+	t.mu.Lock()
+	seq := t.seq
+	t.queue = append(t.queue, t.failed...)
+	t.failed = nil
+	sort.Slice(t.queue, func(i, j int) bool { return t.queue[i].seq < t.queue[j].seq })
+	t.cond.Broadcast()
+	for t.copying(seq) {
+		t.cond.Wait()
+	}
+	var err error
+	if len(t.failed) > 0 && t.failed[0].seq <= seq {
+		err = t.failed[0].err
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return t.slow.Sync()
+}
+
+// Copying reports whether any block numbered seq or lower is queued or in
+// flight. The caller must hold t.mu.
+func (t *Tier) copying(seq uint64) bool {
+	if t.cur != nil && t.cur.seq <= seq {
+		return true
+	}
+	return len(t.queue) > 0 && t.queue[0].seq <= seq
+}
+
+// Close waits for queued blocks to be copied, then stops the copier. Blocks
+// whose copy failed aren't tried again. It returns the last copy error, if
+// any.
+func (t *Tier) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	<-t.done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Enqueue numbers p and adds it to the queue. The caller must hold t.mu.
+func (t *Tier) enqueue(p *pending) {
+	t.seq++
+	p.seq = t.seq
+	t.queue = append(t.queue, p)
+}
+
+func (t *Tier) copier() {
+	defer close(t.done)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		p := t.next()
+		if p == nil {
+			return
+		}
+		t.cur = p
+		t.mu.Unlock()
+
+		err := t.copy(p)
+
+		t.mu.Lock()
+		t.cur = nil
+		if err != nil {
+			t.err = err
+			p.err = err
+			d := retryMin << uint(p.tries)
+			if d > retryMax || d <= 0 {
+				d = retryMax
+			}
+			p.tries++
+			p.retry = time.Now().Add(d)
+			i := sort.Search(len(t.failed), func(i int) bool { return t.failed[i].seq > p.seq })
+			t.failed = append(t.failed, nil)
+			copy(t.failed[i+1:], t.failed[i:])
+			t.failed[i] = p
+		}
+		t.cond.Broadcast()
+	}
+}
+
+// Next waits for a block to copy and takes it off its list: a failed block
+// whose retry time has come, or else the head of the queue. It returns nil
+// once the Tier is closed and the queue is empty. The caller must hold t.mu.
+func (t *Tier) next() *pending {
+	for {
+		now := time.Now()
+		var wake time.Time
+		for i, p := range t.failed {
+			if !p.retry.After(now) && !t.closed {
+				t.failed = append(t.failed[:i], t.failed[i+1:]...)
+				return p
+			}
+			if wake.IsZero() || p.retry.Before(wake) {
+				wake = p.retry
+			}
+		}
+		if len(t.queue) > 0 {
+			p := t.queue[0]
+			t.queue = t.queue[1:]
+			return p
+		}
+		if t.closed {
+			return nil
+		}
+		if wake.IsZero() {
+			t.cond.Wait()
+			continue
+		}
+		tm := time.AfterFunc(wake.Sub(now), func() {
+			t.mu.Lock()
+			t.cond.Broadcast()
+			t.mu.Unlock()
+		})
+		t.cond.Wait()
+		tm.Stop()
+	}
+}
+
+func (t *Tier) copy(p *pending) error {
+	r, err := t.fast.Read(p.score, p.kind, p.size)
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("tier: reading %v: %v", p.score, err)
+	}
+	s, err := t.slow.Write(p.kind, r)
+	if err != nil {
+		return fmt.Errorf("tier: writing %v: %v", p.score, err)
+	}
+	if !bytes.Equal(s, p.score) {
+		return fmt.Errorf("tier: slow tier returned %v for %v", s, p.score)
+	}
+	return nil
+}
+
+// Counter counts the bytes read through it.
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,285 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package tier
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+func TestHandler(t *testing.T) {
+	for _, p := range []Policy{SyncFast, SyncBoth} {
+		tr := New(ventitest.NewMemFS(), ventitest.NewMemFS(), p)
+		ventitest.TestHandler(t, tr)
+		if err := tr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAll(t *testing.T, h venti.Handler, s venti.Score) []byte {
+	r, err := h.Read(s, venti.VtData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	return b
+}
+
+func TestSyncBoth(t *testing.T) {
+	fast, slow := ventitest.NewMemFS(), ventitest.NewMemFS()
+	tr := New(fast, slow, SyncBoth)
+	defer tr.Close()
+
+	var scs []venti.Score
+	for i := 0; i < 10; i++ {
+		s, err := tr.Write(venti.VtData, bytes.NewReader([]byte{byte(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scs = append(scs, s)
+	}
+	if err := tr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := tr.Pending(); n != 0 {
+		t.Fatalf("%d blocks pending after Sync", n)
+	}
+	fast.Reset()
+	for i, s := range scs {
+		if got := readAll(t, slow, s); !bytes.Equal(got, []byte{byte(i)}) {
+			t.Fatalf("slow tier: exp %x, got %x", i, got)
+		}
+		// Reads should fall through to the slow tier.
+		if got := readAll(t, tr, s); !bytes.Equal(got, []byte{byte(i)}) {
+			t.Fatalf("tier: exp %x, got %x", i, got)
+		}
+	}
+}
+
+// flaky fails writes while down is set.
+type flaky struct {
+	venti.Handler
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *flaky) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	f.mu.Lock()
+	down := f.down
+	f.mu.Unlock()
+	if down {
+		return nil, fmt.Errorf("down")
+	}
+	return f.Handler.Write(k, r)
+}
+
+func TestRetry(t *testing.T) {
+	slow := &flaky{Handler: ventitest.NewMemFS(), down: true}
+	tr := New(ventitest.NewMemFS(), slow, SyncBoth)
+	defer tr.Close()
+
+	s, err := tr.Write(venti.VtData, bytes.NewReader([]byte("retry")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Sync(); err == nil {
+		t.Fatal("wanted an error, didn't get one")
+	}
+	if n := tr.Pending(); n != 1 {
+		t.Fatalf("exp 1 pending block, got %d", n)
+	}
+
+	slow.mu.Lock()
+	slow.down = false
+	slow.mu.Unlock()
+	if err := tr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, slow, s); string(got) != "retry" {
+		t.Fatalf("slow tier: exp %q, got %q", "retry", got)
+	}
+}
+
+// The copier retries a failed copy by itself, even with SyncFast.
+func TestRetryBackground(t *testing.T) {
+	defer func(d time.Duration) { retryMin = d }(retryMin)
+	retryMin = time.Millisecond
+	slow := &flaky{Handler: ventitest.NewMemFS(), down: true}
+	tr := New(ventitest.NewMemFS(), slow, SyncFast)
+	defer tr.Close()
+
+	s, err := tr.Write(venti.VtData, bytes.NewReader([]byte("retry")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for failed := false; !failed; time.Sleep(time.Millisecond) {
+		tr.mu.Lock()
+		failed = tr.err != nil
+		tr.mu.Unlock()
+	}
+	slow.mu.Lock()
+	slow.down = false
+	slow.mu.Unlock()
+	for deadline := time.Now().Add(10 * time.Second); tr.Pending() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("failed copy never retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := readAll(t, slow, s); string(got) != "retry" {
+		t.Fatalf("slow tier: exp %q, got %q", "retry", got)
+	}
+}
+
+// slowWrites makes every write take a while.
+type slowWrites struct {
+	venti.Handler
+}
+
+func (s slowWrites) Write(k venti.Type, r io.Reader) (venti.Score, error) {
+	time.Sleep(5 * time.Millisecond)
+	return s.Handler.Write(k, r)
+}
+
+// Sync returns once the blocks written before it are copied, even if writes
+// keep the queue from ever emptying.
+func TestSyncEarlier(t *testing.T) {
+	slow := slowWrites{ventitest.NewMemFS()}
+	tr := New(ventitest.NewMemFS(), slow, SyncBoth)
+	defer tr.Close()
+
+	// Blocks are written faster than they're copied.
+	stop, started := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			if i == 10 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if _, err := tr.Write(venti.VtData, bytes.NewReader([]byte(fmt.Sprint(i)))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	<-started
+	s, err := tr.Write(venti.VtData, bytes.NewReader([]byte("before")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- tr.Sync() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Sync waited for blocks written after it")
+	}
+	if got := readAll(t, slow, s); string(got) != "before" {
+		t.Fatalf("slow tier: exp %q, got %q", "before", got)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	slow := ventitest.NewMemFS()
+	go venti.Serve(l, slow.Handshake)
+	c, err := venti.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tr := New(ventitest.NewMemFS(), c.Handler(), SyncBoth)
+	defer tr.Close()
+	s, err := tr.Write(venti.VtData, bytes.NewReader([]byte("remote")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, slow, s); string(got) != "remote" {
+		t.Fatalf("slow tier: exp %q, got %q", "remote", got)
+	}
+}
+
+// Blocks left behind by an earlier Tier are found and copied by Rescan.
+func TestRescan(t *testing.T) {
+	fast, slow := ventitest.NewMemFS(), ventitest.NewMemFS()
+	var scs []venti.Score
+	for i := 0; i < 10; i++ {
+		// Half are already in the slow tier, as if copied before a crash.
+		if i%2 == 0 {
+			if _, err := slow.Write(venti.VtData, bytes.NewReader([]byte{byte(i)})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, err := fast.Write(venti.VtData, bytes.NewReader([]byte{byte(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scs = append(scs, s)
+	}
+
+	tr := New(fast, slow, SyncBoth)
+	defer tr.Close()
+	n, err := tr.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("exp 5 blocks queued, got %d", n)
+	}
+	if err := tr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range scs {
+		if got := readAll(t, slow, s); !bytes.Equal(got, []byte{byte(i)}) {
+			t.Fatalf("slow tier: exp %x, got %x", i, got)
+		}
+	}
+
+	tr = New(ventitest.NewErrFS(venti.ErrNotFound), slow, SyncBoth)
+	defer tr.Close()
+	if _, err := tr.Rescan(); err == nil {
+		t.Fatal("rescan of a fast tier that can't walk succeeded")
+	}
+}
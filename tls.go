@@ -0,0 +1,100 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// TLSMethod is the Thello.AuthMethod for a client identified by its TLS
+// certificate.
+const TLSMethod = "tls"
+
+// ListenAndServeTLS is like ListenAndServe, but serves TLS connections using
+// the certificate and key in the named files.
+func ListenAndServeTLS(addr, certFile, keyFile string, h Handshake) error {
+	return (&Server{Handshake: h}).ListenAndServeTLS(addr, certFile, keyFile)
+}
+
+// ServeTLS is like Serve, but wraps each connection in TLS, using
+// s.TLSConfig. If certFile and keyFile aren't empty, the certificate and key
+// in them are added to the configuration.
+//
+// If the client presents a verified certificate, the Handshake sees its
+// subject's common name as the UID, in place of the one the client claimed,
+// and TLSMethod as the AuthMethod. Set ClientAuth and ClientCAs in TLSConfig
+// to require one.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	cfg := &tls.Config{}
+	if s.TLSConfig != nil {
+		cfg = s.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+	return s.Serve(tls.NewListener(l, cfg))
+}
+
+// ListenAndServeTLS listens on addr, as for Listen, and calls ServeTLS on
+// the resulting net.Listener.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	l, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// DialTLS connects to the venti server at addr, a dial string as for
+// DialAddr, over TLS. A client certificate for servers that want one goes in
+// cfg.Certificates.
+func DialTLS(addr string, cfg *tls.Config) (*Client, error) {
+	network, address, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" && network != "unix" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	nc, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(nc, cfg)
+	if err := conn.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return NewClient(conn)
+}
+
+// TLSIdentity fills in hello from the TLS connection's client certificate,
+// if there is one.
+func tlsIdentity(nc net.Conn, hello *Thello) {
+	tc, ok := nc.(*tls.Conn)
+	if !ok {
+		return
+	}
+	st := tc.ConnectionState()
+	hello.TLS = &st
+	if len(st.VerifiedChains) == 0 {
+		return
+	}
+	hello.UID = st.VerifiedChains[0][0].Subject.CommonName
+	hello.AuthMethod = TLSMethod
+}
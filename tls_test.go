@@ -0,0 +1,190 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package venti_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hdonnay/venti"
+	"github.com/hdonnay/venti/ventitest"
+)
+
+// TestPKI is a CA and certificates it signed, made fresh for each test.
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	p := &testPKI{pool: x509.NewCertPool()}
+	p.ca, p.caKey = p.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	p.pool.AddCert(p.ca)
+	return p
+}
+
+// Issue signs tmpl with the CA, or itself if there's no CA yet.
+func (p *testPKI) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.serial++
+	tmpl.SerialNumber = big.NewInt(p.serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if p.ca != nil {
+		parent, signer = p.ca, p.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (p *testPKI) pair(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	cert, key := p.issue(t, tmpl)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+func (p *testPKI) server(t *testing.T) tls.Certificate {
+	return p.pair(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "venti"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+func (p *testPKI) client(t *testing.T, name string) tls.Certificate {
+	return p.pair(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func TestServeTLS(t *testing.T) {
+	p := newTestPKI(t)
+	dir, err := ioutil.TempDir("", "venti-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := p.server(t)
+	der, err := x509.MarshalECPrivateKey(srv.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &venti.Server{Handshake: ventitest.NewMemFS().Handshake}
+	go s.ServeTLS(l, certFile, keyFile)
+
+	c, err := venti.DialTLS(l.Addr().String(), &tls.Config{RootCAs: p.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ventitest.TestHandler(t, c.Handler())
+}
+
+// DialTLS takes a dial string, as DialAddr does.
+func TestDialTLSAddr(t *testing.T) {
+	p := newTestPKI(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &venti.Server{
+		Handshake: ventitest.NewMemFS().Handshake,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{p.server(t)}},
+	}
+	go s.ServeTLS(l, "", "")
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := venti.DialTLS("tcp!127.0.0.1!"+port, &tls.Config{RootCAs: p.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ventitest.TestHandler(t, c.Handler())
+}
+
+func TestMutualTLS(t *testing.T) {
+	p := newTestPKI(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hellos := make(chan *venti.Thello, 1)
+	fs := ventitest.NewMemFS()
+	s := &venti.Server{
+		Handshake: func(th *venti.Thello) (*venti.Rhello, venti.Handler, error) {
+			hellos <- th
+			return fs.Handshake(th)
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{p.server(t)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    p.pool,
+		},
+	}
+	go s.ServeTLS(l, "", "")
+
+	c, err := venti.DialTLS(l.Addr().String(), &tls.Config{
+		RootCAs:      p.pool,
+		Certificates: []tls.Certificate{p.client(t, "glenda")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The certificate's name replaces the UID the client sent.
+	if th := <-hellos; th.UID != "glenda" || th.AuthMethod != venti.TLSMethod {
+		t.Fatalf("exp glenda by %s, got %s by %q", venti.TLSMethod, th.UID, th.AuthMethod)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No certificate, no session.
+	if c, err := venti.DialTLS(l.Addr().String(), &tls.Config{RootCAs: p.pool}); err == nil {
+		c.Close()
+		t.Fatal("wanted an error, didn't get one")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package ventitest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/hdonnay/venti"
+)
+
+// TestHandler runs the tests every venti.Handler is expected to pass against
+// h. The tests write blocks into h, so it should be disposable.
+func TestHandler(t *testing.T, h venti.Handler) {
+	t.Run("ReadWrite", func(t *testing.T) { testReadWrite(t, h) })
+	t.Run("Rewrite", func(t *testing.T) { testRewrite(t, h) })
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, h) })
+	t.Run("Missing", func(t *testing.T) { testMissing(t, h) })
+	t.Run("TypeMismatch", func(t *testing.T) { testTypeMismatch(t, h) })
+	t.Run("TwoTypes", func(t *testing.T) { testTwoTypes(t, h) })
+	t.Run("Has", func(t *testing.T) { testHas(t, h) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, h) })
+	t.Run("Sync", func(t *testing.T) {
+		if err := h.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// block returns sz bytes of random data.
+func block(sz int) []byte {
+	b := make([]byte, sz)
+	rand.Read(b)
+	return b
+}
+
+// readBlock reads the block (s, k) out of h and closes the returned reader,
+// if needed.
+func readBlock(h venti.Handler, s venti.Score, k venti.Type, ct int64) ([]byte, error) {
+	r, err := h.Read(s, k, ct)
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// writeBlock writes b to h and checks the returned score.
+func writeBlock(h venti.Handler, k venti.Type, b []byte) (venti.Score, error) {
+	s, err := h.Write(k, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if exp := sha1.Sum(b); !bytes.Equal(exp[:], s) {
+		return nil, fmt.Errorf("bad score: exp %v, got %v", venti.Score(exp[:]), s)
+	}
+	return s, nil
+}
+
+func testReadWrite(t *testing.T, h venti.Handler) {
+	for i := 0; i < 20; i++ {
+		b := block(rand.Intn(1 << 15))
+		s, err := writeBlock(h, venti.VtData, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readBlock(h, s, venti.VtData, int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, got) {
+			t.Fatalf("block %v: read back different data", s)
+		}
+	}
+}
+
+func testRewrite(t *testing.T, h venti.Handler) {
+	b := block(1024)
+	s1, err := writeBlock(h, venti.VtData, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := writeBlock(h, venti.VtData, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s1, s2) {
+		t.Fatalf("rewrite changed score: %v != %v", s1, s2)
+	}
+	got, err := readBlock(h, s1, venti.VtData, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatalf("block %v: read back different data", s1)
+	}
+}
+
+func testEmpty(t *testing.T, h venti.Handler) {
+	s, err := writeBlock(h, venti.VtData, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readBlock(h, s, venti.VtData, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("empty block: read back %d bytes", len(got))
+	}
+}
+
+func testMissing(t *testing.T, h venti.Handler) {
+	s := sha1.Sum(block(64))
+	_, err := readBlock(h, venti.Score(s[:]), venti.VtData, 64)
+	if !errors.Is(err, venti.ErrNotFound) {
+		t.Fatalf("exp %v, got %v", venti.ErrNotFound, err)
+	}
+}
+
+func testTypeMismatch(t *testing.T, h venti.Handler) {
+	// Big enough that a Handler that stores large blocks differently gets
+	// both paths checked.
+	for _, sz := range []int{128, 1 << 16} {
+		b := block(sz)
+		s, err := writeBlock(h, venti.VtData, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readBlock(h, s, venti.VtDir, int64(sz))
+		if !errors.Is(err, venti.ErrTypeMismatch) {
+			t.Fatalf("block %v read as VtDir: exp %v, got %v", s, venti.ErrTypeMismatch, err)
+		}
+		if _, err := readBlock(h, s, venti.VtData, int64(sz)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A block is identified by its score and type, so the same data can be
+// written as two types and read back as both. A Handler may refuse the second
+// type with venti.ErrTypeMismatch instead.
+func testTwoTypes(t *testing.T, h venti.Handler) {
+	for _, sz := range []int{128, 1 << 16} {
+		b := block(sz)
+		for _, k := range []venti.Type{venti.VtData, venti.VtDir} {
+			_, err := writeBlock(h, k, b)
+			if errors.Is(err, venti.ErrTypeMismatch) && k == venti.VtDir {
+				t.Skip("handler keeps one type per score")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := sha1.Sum(b)
+		for _, k := range []venti.Type{venti.VtData, venti.VtDir} {
+			got, err := readBlock(h, s[:], k, int64(sz))
+			if err != nil {
+				t.Fatalf("block %v as type %d: %v", venti.Score(s[:]), k, err)
+			}
+			if !bytes.Equal(b, got) {
+				t.Fatalf("block %v as type %d: read back different data", venti.Score(s[:]), k)
+			}
+		}
+	}
+}
+
+// Has should agree with Read. Handlers that aren't a venti.Haser are
+// checked too, through the fallback in venti.Has.
+func testHas(t *testing.T, h venti.Handler) {
+	for _, sz := range []int{128, 1 << 16} {
+		b := block(sz)
+		s, err := writeBlock(h, venti.VtData, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing := sha1.Sum(block(sz))
+		for _, tc := range []struct {
+			s   venti.Score
+			k   venti.Type
+			exp bool
+		}{
+			{s, venti.VtData, true},
+			{s, venti.VtDir, false},
+			{missing[:], venti.VtData, false},
+		} {
+			ok, err := venti.Has(h, tc.s, tc.k)
+			if err != nil {
+				t.Fatalf("block %v as type %d: %v", tc.s, tc.k, err)
+			}
+			if ok != tc.exp {
+				t.Fatalf("block %v as type %d: exp %v, got %v", tc.s, tc.k, tc.exp, ok)
+			}
+		}
+	}
+}
+
+func testConcurrent(t *testing.T, h venti.Handler) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := block(rand.Intn(1 << 12))
+			s, err := writeBlock(h, venti.VtData, b)
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, err := readBlock(h, s, venti.VtData, int64(len(b)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(b, got) {
+				errs <- fmt.Errorf("block %v: read back different data", s)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -29,6 +29,10 @@ func (e *ErrFS) Read(_ venti.Score, _ venti.Type, _ int64) (io.Reader, error) {
 	return nil, e.Err
 }
 
+func (e *ErrFS) Has(_ venti.Score, _ venti.Type) (bool, error) {
+	return false, e.Err
+}
+
 func (e *ErrFS) Sync() error {
 	return e.Err
 }
@@ -7,7 +7,6 @@ package ventitest
 import (
 	"bytes"
 	"crypto/sha1"
-	"fmt"
 	"hash"
 	"io"
 	"sync"
@@ -20,28 +19,36 @@ var zeroScore = make([]byte, 20)
 func NewMemFS() *MemFS {
 	return &MemFS{
 		mu:    &sync.RWMutex{},
-		block: make(map[string][]byte),
+		block: make(map[string]map[venti.Type]memBlock),
 		h:     sha1.New(),
 	}
 }
 
 type MemFS struct {
-	mu    *sync.RWMutex
-	block map[string][]byte
+	mu *sync.RWMutex
+	// Block is keyed by score, then type: the same data can be stored as
+	// more than one type.
+	block map[string]map[venti.Type]memBlock
 	h     hash.Hash
 }
 
+type memBlock struct {
+	score venti.Score
+	kind  venti.Type
+	data  []byte
+}
+
 func (fs *MemFS) Reset() {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	fs.block = make(map[string][]byte)
+	fs.block = make(map[string]map[venti.Type]memBlock)
 }
 
 func (fs *MemFS) Handshake(t *venti.Thello) (*venti.Rhello, venti.Handler, error) {
 	return nil, fs, nil
 }
 
-func (fs *MemFS) Write(_ venti.Type, r io.Reader) (venti.Score, error) {
+func (fs *MemFS) Write(k venti.Type, r io.Reader) (venti.Score, error) {
 	buf := &bytes.Buffer{}
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -51,18 +58,55 @@ func (fs *MemFS) Write(_ venti.Type, r io.Reader) (venti.Score, error) {
 	}
 
 	s := venti.Score(fs.h.Sum(nil))
-	fs.block[s.String()] = buf.Bytes()
+	bs, ok := fs.block[s.String()]
+	if !ok {
+		bs = make(map[venti.Type]memBlock)
+		fs.block[s.String()] = bs
+	}
+	bs[k] = memBlock{score: s, kind: k, data: buf.Bytes()}
 	return s, nil
 }
 
-func (fs *MemFS) Read(s venti.Score, _ venti.Type, ct int64) (io.Reader, error) {
+func (fs *MemFS) Read(s venti.Score, k venti.Type, ct int64) (io.Reader, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
-	b, ok := fs.block[s.String()]
+	bs, ok := fs.block[s.String()]
 	if !ok {
-		return nil, fmt.Errorf("no such block")
+		return nil, venti.ErrNotFound
+	}
+	b, ok := bs[k]
+	if !ok {
+		for t := range bs {
+			return nil, venti.CheckType(s, t, k)
+		}
+	}
+	return bytes.NewReader(b.data), nil
+}
+
+// Has reports whether fs has the block (s, k), without copying it.
+func (fs *MemFS) Has(s venti.Score, k venti.Type) (bool, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	_, ok := fs.block[s.String()][k]
+	return ok, nil
+}
+
+// Walk calls fn for every block in fs, stopping at the first error.
+func (fs *MemFS) Walk(fn func(venti.Score, venti.Type, int64) error) error {
+	fs.mu.RLock()
+	bs := make([]memBlock, 0, len(fs.block))
+	for _, ts := range fs.block {
+		for _, b := range ts {
+			bs = append(bs, b)
+		}
 	}
-	return bytes.NewReader(b), nil
+	fs.mu.RUnlock()
+	for _, b := range bs {
+		if err := fn(b.score, b.kind, int64(len(b.data))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (fs *MemFS) Sync() error {
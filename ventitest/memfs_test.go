@@ -0,0 +1,11 @@
+// Copyright 2016 The Venti Authors. All rights reserved.
+// Use of this source code is governed by an ISC-style
+// license that can be found in the LICENSE file.
+
+package ventitest
+
+import "testing"
+
+func TestMemFS(t *testing.T) {
+	TestHandler(t, NewMemFS())
+}